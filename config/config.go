@@ -0,0 +1,582 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web"
+)
+
+const (
+	DefaultPort      = 8080
+	DefaultCertFile  = "./secrets/server.crt"
+	DefaultKeyFile   = "./secrets/server.key"
+	DefaultUploadDir = "./uploaded"
+
+	// Prefix of every environment variable read by Load
+	EnvPrefix = "FILETE_"
+)
+
+// Config holds every user configurable setting of the server. Values are
+// resolved in the following order, each one overriding the previous:
+// defaults, config file, environment variables and command-line flags.
+type Config struct {
+	Port       uint16 `json:"port" toml:"port" yaml:"port"`
+	Bind       string `json:"bind" toml:"bind" yaml:"bind"`
+	CertFile   string `json:"cert" toml:"cert" yaml:"cert"`
+	KeyFile    string `json:"key" toml:"key" yaml:"key"`
+	SelfSigned bool   `json:"self-signed" toml:"self-signed" yaml:"self-signed"`
+	// Directory to cache the generated self-signed certificate in
+	CertCacheDir string   `json:"cert-cache-dir" toml:"cert-cache-dir" yaml:"cert-cache-dir"`
+	UploadDir    string   `json:"upload-dir" toml:"upload-dir" yaml:"upload-dir"`
+	ShareDirs    []string `json:"share" toml:"share" yaml:"share"`
+	// Shares with their own options. Entries of ShareDirs use the global ones.
+	Shares     []ShareConfig `json:"shares" toml:"shares" yaml:"shares"`
+	Symlinks   string        `json:"symlinks" toml:"symlinks" yaml:"symlinks"`
+	ShowHidden bool          `json:"show-hidden" toml:"show-hidden" yaml:"show-hidden"`
+	// Whether .gitignore and .fileteignore files in shares are honored
+	IgnoreFiles bool `json:"ignore-files" toml:"ignore-files" yaml:"ignore-files"`
+	// .gitignore style patterns excluded from every share
+	Exclude    []string `json:"exclude" toml:"exclude" yaml:"exclude"`
+	SessionKey string   `json:"session-key" toml:"session-key" yaml:"session-key"`
+	// Keys granting roles other than admin
+	SessionKeys []SessionKeyConfig `json:"session-keys" toml:"session-keys" yaml:"session-keys"`
+	// Identities that can't be claimed by guests, e.g. to grant them access
+	// to shares
+	Identities []IdentityConfig `json:"identities" toml:"identities" yaml:"identities"`
+	// Backend storing messages: file or bolt
+	MessageStore string `json:"message-store" toml:"message-store" yaml:"message-store"`
+	// When the message store is synced to disk: always, interval or never
+	MessageFsync string `json:"message-fsync" toml:"message-fsync" yaml:"message-fsync"`
+	// Where sessions are kept: memory or file
+	SessionStore string `json:"session-store" toml:"session-store" yaml:"session-store"`
+	// Replace the session key after this many wrong keys. Disabled if 0.
+	RotateKeyAfter int `json:"rotate-key-after" toml:"rotate-key-after" yaml:"rotate-key-after"`
+	// Groups of 4 characters, 20 bits each, in a generated session key
+	SessionKeyGroups int `json:"session-key-groups" toml:"session-key-groups" yaml:"session-key-groups"`
+	// Random bytes in a session id
+	SessionIdBytes int `json:"session-id-bytes" toml:"session-id-bytes" yaml:"session-id-bytes"`
+}
+
+// A shared directory with options overriding the global ones
+type ShareConfig struct {
+	Path        string `json:"path" toml:"path" yaml:"path"`
+	Symlinks    string `json:"symlinks" toml:"symlinks" yaml:"symlinks"`
+	ShowHidden  *bool  `json:"show-hidden" toml:"show-hidden" yaml:"show-hidden"`
+	IgnoreFiles *bool  `json:"ignore-files" toml:"ignore-files" yaml:"ignore-files"`
+	// Roles and registered identities allowed to access the share besides
+	// admins. Everyone may if both are empty.
+	AllowRoles      []string `json:"allow-roles" toml:"allow-roles" yaml:"allow-roles"`
+	AllowIdentities []string `json:"allow-identities" toml:"allow-identities" yaml:"allow-identities"`
+}
+
+// An additional session key and the role it grants
+type SessionKeyConfig struct {
+	Key  string `json:"key" toml:"key" yaml:"key"`
+	Role string `json:"role" toml:"role" yaml:"role"`
+}
+
+// An identity set up by the admin. The secret is only stored as bcrypt hash,
+// see `filete hash-secret`.
+type IdentityConfig struct {
+	Alias      string `json:"alias" toml:"alias" yaml:"alias"`
+	SecretHash string `json:"secret-hash" toml:"secret-hash" yaml:"secret-hash"`
+}
+
+func Default() Config {
+	return Config{
+		Port:         DefaultPort,
+		CertFile:     DefaultCertFile,
+		KeyFile:      DefaultKeyFile,
+		UploadDir:    DefaultUploadDir,
+		Symlinks:     string(services.DefaultSymlinkPolicy),
+		IgnoreFiles:  true,
+		MessageStore: string(data.DefaultMessageStore),
+		MessageFsync: string(data.DefaultFsyncPolicy),
+		SessionStore: string(services.DefaultSessionStore),
+		// Defaults of the services, kept here so they show up in --help
+		SessionKeyGroups: services.DefaultSessionKeyGroups,
+		SessionIdBytes:   services.DefaultSessionIdBytes,
+	}
+}
+
+// Load builds a Config from the given command-line arguments (without the
+// program name), the optional config file they point to and the environment.
+// Positional arguments are treated as additional directories to share.
+func Load(args []string) (Config, error) {
+	return load(args, os.Getenv)
+}
+
+func load(args []string, getenv func(string) string) (Config, error) {
+	var (
+		configFile  string
+		port        uint
+		bind        string
+		certFile    string
+		keyFile     string
+		selfSigned  bool
+		certCache   string
+		uploadDir   string
+		shareDirs   stringList
+		symlinks    string
+		showHidden  bool
+		ignoreFiles bool
+		exclude     stringList
+		sessionKey  string
+		msgStore    string
+		msgFsync    string
+		sessStore   string
+		rotateAfter int
+		keyGroups   int
+		idBytes     int
+	)
+
+	flags := flag.NewFlagSet("filete", flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", "", "path to a TOML, YAML or JSON config file")
+	flags.UintVar(&port, "port", DefaultPort, "port to listen on")
+	flags.StringVar(&bind, "bind", "", "address to bind to (all interfaces if empty)")
+	flags.StringVar(&certFile, "cert", DefaultCertFile, "path to the TLS certificate")
+	flags.StringVar(&keyFile, "key", DefaultKeyFile, "path to the TLS private key")
+	flags.BoolVar(&selfSigned, "self-signed", false, "generate a self-signed TLS certificate instead of using --cert and --key")
+	flags.StringVar(&certCache, "cert-cache-dir", "", "directory to persist the self-signed certificate in")
+	flags.StringVar(&uploadDir, "upload-dir", DefaultUploadDir, "directory to save uploaded files in")
+	flags.Var(&shareDirs, "share", "directory to share (can be repeated)")
+	flags.StringVar(&symlinks, "symlinks", string(services.DefaultSymlinkPolicy), "how symlinks in shared directories are treated: follow, list or hide")
+	flags.BoolVar(&showHidden, "show-hidden", false, "list and allow downloading dotfiles in shared directories")
+	flags.BoolVar(&ignoreFiles, "ignore-files", true, "honor .gitignore and .fileteignore files in shared directories")
+	flags.Var(&exclude, "exclude", ".gitignore style pattern to exclude from all shared directories (can be repeated)")
+	flags.StringVar(&sessionKey, "session-key", "", "key clients must enter to authenticate as admin (random if empty)")
+	flags.StringVar(&msgStore, "message-store", string(data.DefaultMessageStore), "backend storing messages: file or bolt")
+	flags.StringVar(&msgFsync, "message-fsync", string(data.DefaultFsyncPolicy), "when messages are synced to disk: always, interval or never")
+	flags.StringVar(&sessStore, "session-store", string(services.DefaultSessionStore), "where sessions are kept: memory or file (survives restarts)")
+	flags.IntVar(&rotateAfter, "rotate-key-after", 0, "replace the session key after this many wrong keys (never if 0)")
+	flags.IntVar(&keyGroups, "session-key-groups", services.DefaultSessionKeyGroups, fmt.Sprintf("groups of 4 characters in a generated session key (at least %d)", services.MinSessionKeyGroups))
+	flags.IntVar(&idBytes, "session-id-bytes", services.DefaultSessionIdBytes, fmt.Sprintf("random bytes in a session id (at least %d)", services.MinSessionIdBytes))
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: filete [flags] [share-dir...]\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if configFile == "" {
+		configFile = getenv(EnvPrefix + "CONFIG")
+	}
+
+	c := Default()
+	if configFile != "" {
+		if err := c.readFile(configFile); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := c.applyEnv(getenv); err != nil {
+		return Config{}, err
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			if port > 0xFFFF {
+				err = fmt.Errorf("Invalid port %d", port)
+			}
+			c.Port = uint16(port)
+		case "bind":
+			c.Bind = bind
+		case "cert":
+			c.CertFile = certFile
+		case "key":
+			c.KeyFile = keyFile
+		case "self-signed":
+			c.SelfSigned = selfSigned
+		case "cert-cache-dir":
+			c.CertCacheDir = certCache
+		case "upload-dir":
+			c.UploadDir = uploadDir
+		case "share":
+			c.ShareDirs = append(c.ShareDirs, shareDirs...)
+		case "symlinks":
+			c.Symlinks = symlinks
+		case "show-hidden":
+			c.ShowHidden = showHidden
+		case "ignore-files":
+			c.IgnoreFiles = ignoreFiles
+		case "exclude":
+			c.Exclude = append(c.Exclude, exclude...)
+		case "session-key":
+			c.SessionKey = sessionKey
+		case "message-store":
+			c.MessageStore = msgStore
+		case "message-fsync":
+			c.MessageFsync = msgFsync
+		case "session-store":
+			c.SessionStore = sessStore
+		case "rotate-key-after":
+			c.RotateKeyAfter = rotateAfter
+		case "session-key-groups":
+			c.SessionKeyGroups = keyGroups
+		case "session-id-bytes":
+			c.SessionIdBytes = idBytes
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.ShareDirs = append(c.ShareDirs, flags.Args()...)
+
+	return c, nil
+}
+
+// Decodes the config file at path into c. The format is picked by the file
+// extension and unknown keys are rejected to catch typos early.
+func (c *Config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.Decode(string(content), c)
+		if err != nil {
+			return fmt.Errorf("Invalid config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("Invalid config file %s: unknown key '%s'", path, undecoded[0])
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("Invalid config file %s: %w", path, err)
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(c); err != nil {
+			return fmt.Errorf("Invalid config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("Unsupported config file format: %s", path)
+	}
+
+	return nil
+}
+
+// Overrides values of c with the FILETE_* environment variables that are set.
+// FILETE_SHARE holds a list of directories separated by os.PathListSeparator.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	if v := getenv(EnvPrefix + "PORT"); v != "" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return fmt.Errorf("Invalid %sPORT '%s'", EnvPrefix, v)
+		}
+		c.Port = uint16(port)
+	}
+	if v := getenv(EnvPrefix + "BIND"); v != "" {
+		c.Bind = v
+	}
+	if v := getenv(EnvPrefix + "CERT"); v != "" {
+		c.CertFile = v
+	}
+	if v := getenv(EnvPrefix + "KEY"); v != "" {
+		c.KeyFile = v
+	}
+	if v := getenv(EnvPrefix + "SELF_SIGNED"); v != "" {
+		selfSigned, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %sSELF_SIGNED '%s'", EnvPrefix, v)
+		}
+		c.SelfSigned = selfSigned
+	}
+	if v := getenv(EnvPrefix + "CERT_CACHE_DIR"); v != "" {
+		c.CertCacheDir = v
+	}
+	if v := getenv(EnvPrefix + "UPLOAD_DIR"); v != "" {
+		c.UploadDir = v
+	}
+	if v := getenv(EnvPrefix + "SHARE"); v != "" {
+		c.ShareDirs = append(c.ShareDirs, filepath.SplitList(v)...)
+	}
+	if v := getenv(EnvPrefix + "SYMLINKS"); v != "" {
+		c.Symlinks = v
+	}
+	if v := getenv(EnvPrefix + "SHOW_HIDDEN"); v != "" {
+		showHidden, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %sSHOW_HIDDEN '%s'", EnvPrefix, v)
+		}
+		c.ShowHidden = showHidden
+	}
+	if v := getenv(EnvPrefix + "IGNORE_FILES"); v != "" {
+		ignoreFiles, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %sIGNORE_FILES '%s'", EnvPrefix, v)
+		}
+		c.IgnoreFiles = ignoreFiles
+	}
+	if v := getenv(EnvPrefix + "EXCLUDE"); v != "" {
+		c.Exclude = append(c.Exclude, strings.Split(v, ",")...)
+	}
+	if v := getenv(EnvPrefix + "SESSION_KEY"); v != "" {
+		c.SessionKey = v
+	}
+	if v := getenv(EnvPrefix + "MESSAGE_STORE"); v != "" {
+		c.MessageStore = v
+	}
+	if v := getenv(EnvPrefix + "MESSAGE_FSYNC"); v != "" {
+		c.MessageFsync = v
+	}
+	if v := getenv(EnvPrefix + "SESSION_STORE"); v != "" {
+		c.SessionStore = v
+	}
+	if v := getenv(EnvPrefix + "ROTATE_KEY_AFTER"); v != "" {
+		rotateAfter, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %sROTATE_KEY_AFTER '%s'", EnvPrefix, v)
+		}
+		c.RotateKeyAfter = rotateAfter
+	}
+	if v := getenv(EnvPrefix + "SESSION_KEY_GROUPS"); v != "" {
+		keyGroups, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %sSESSION_KEY_GROUPS '%s'", EnvPrefix, v)
+		}
+		c.SessionKeyGroups = keyGroups
+	}
+	if v := getenv(EnvPrefix + "SESSION_ID_BYTES"); v != "" {
+		idBytes, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %sSESSION_ID_BYTES '%s'", EnvPrefix, v)
+		}
+		c.SessionIdBytes = idBytes
+	}
+
+	return nil
+}
+
+// Validate checks that c describes a server that can be started.
+func (c Config) Validate() error {
+	if c.Port == 0 {
+		return errors.New("Port must be between 1 and 65535")
+	}
+
+	if !c.SelfSigned {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return errors.New("Both a TLS certificate and key are required unless self-signed is enabled")
+		}
+		for _, path := range []string{c.CertFile, c.KeyFile} {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("Invalid TLS file: %w", err)
+			}
+		}
+	}
+
+	if c.UploadDir == "" {
+		return errors.New("Upload directory must not be empty")
+	}
+	if info, err := os.Stat(c.UploadDir); err == nil && !info.IsDir() {
+		return fmt.Errorf("Upload directory %s is not a directory", c.UploadDir)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Invalid upload directory: %w", err)
+	}
+
+	if _, err := services.ParseSymlinkPolicy(c.Symlinks); err != nil {
+		return err
+	}
+
+	if _, err := data.ParseMessageStore(c.MessageStore); err != nil {
+		return err
+	}
+	if _, err := data.ParseFsyncPolicy(c.MessageFsync); err != nil {
+		return err
+	}
+	if _, err := services.ParseSessionStore(c.SessionStore); err != nil {
+		return err
+	}
+	if c.RotateKeyAfter < 0 {
+		return errors.New("rotate-key-after must not be negative")
+	}
+	if c.SessionKeyGroups < services.MinSessionKeyGroups {
+		return fmt.Errorf("session-key-groups must be at least %d", services.MinSessionKeyGroups)
+	}
+	if c.SessionIdBytes < services.MinSessionIdBytes {
+		return fmt.Errorf("session-id-bytes must be at least %d", services.MinSessionIdBytes)
+	}
+
+	seenKeys := map[string]bool{c.SessionKey: c.SessionKey != ""}
+	for _, key := range c.SessionKeys {
+		if key.Key == "" {
+			return errors.New("Session keys must not be empty")
+		}
+		if seenKeys[key.Key] {
+			return errors.New("Session keys must be unique")
+		}
+		seenKeys[key.Key] = true
+		if _, err := services.ParseRole(key.Role); err != nil {
+			return fmt.Errorf("Session key: %w", err)
+		}
+	}
+
+	seenAliases := make(map[string]bool, len(c.Identities))
+	for _, identity := range c.Identities {
+		if err := services.ValidateIdentity(identity.identity()); err != nil {
+			return err
+		}
+		if seenAliases[strings.ToLower(identity.Alias)] {
+			return fmt.Errorf("Identity '%s' is defined twice", identity.Alias)
+		}
+		seenAliases[strings.ToLower(identity.Alias)] = true
+	}
+
+	for _, share := range c.shares() {
+		info, err := os.Stat(share.Path)
+		if err != nil {
+			return fmt.Errorf("Invalid shared directory: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Shared directory %s is not a directory", share.Path)
+		}
+
+		if _, err := services.ParseSymlinkPolicy(share.Symlinks); err != nil {
+			return fmt.Errorf("Shared directory %s: %w", share.Path, err)
+		}
+		for _, role := range share.AllowRoles {
+			if _, err := services.ParseRole(role); err != nil {
+				return fmt.Errorf("Shared directory %s: %w", share.Path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ServerConfigs validates c and converts it into the configs expected by
+// web.StartServer.
+func (c Config) ServerConfigs(assets fs.FS) (web.ServerConfigs, error) {
+	if err := c.Validate(); err != nil {
+		return web.ServerConfigs{}, err
+	}
+
+	shares := c.shares()
+	shareDirs := make([]services.SharedDirectoryConfig, 0, len(shares))
+	seen := make(map[string]bool, len(shares))
+	for _, share := range shares {
+		path := filepath.Clean(share.Path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		// Already validated
+		symlinks, _ := services.ParseSymlinkPolicy(share.Symlinks)
+		allowedRoles := make([]services.Role, 0, len(share.AllowRoles))
+		for _, role := range share.AllowRoles {
+			allowedRoles = append(allowedRoles, services.Role(role))
+		}
+		shareDirs = append(shareDirs, services.SharedDirectoryConfig{
+			Path:           path,
+			Symlinks:       symlinks,
+			ShowHidden:     *share.ShowHidden,
+			IgnoreFiles:    *share.IgnoreFiles,
+			AllowedRoles:   allowedRoles,
+			AllowedAliases: share.AllowIdentities,
+		})
+	}
+
+	sessionKeys := make([]services.SessionKeyConfig, 0, len(c.SessionKeys))
+	for _, key := range c.SessionKeys {
+		// Already validated
+		sessionKeys = append(sessionKeys, services.SessionKeyConfig{Key: key.Key, Role: services.Role(key.Role)})
+	}
+
+	identities := make([]data.Identity, 0, len(c.Identities))
+	for _, identity := range c.Identities {
+		identities = append(identities, identity.identity())
+	}
+
+	return web.ServerConfigs{
+		Port:         c.Port,
+		Bind:         c.Bind,
+		CertFile:     c.CertFile,
+		KeyFile:      c.KeyFile,
+		SelfSigned:   c.SelfSigned,
+		CertCacheDir: c.CertCacheDir,
+		Assets:       assets,
+		UploadDir:    c.UploadDir,
+		ShareDirs:    shareDirs,
+		Excludes:     c.Exclude,
+		SessionKey:   c.SessionKey,
+		SessionKeys:  sessionKeys,
+		Identities:   identities,
+		// Already validated
+		MessageStore:     data.MessageStore(c.MessageStore),
+		MessageFsync:     data.FsyncPolicy(c.MessageFsync),
+		SessionStore:     services.SessionStoreType(c.SessionStore),
+		RotateKeyAfter:   c.RotateKeyAfter,
+		SessionKeyGroups: c.SessionKeyGroups,
+		SessionIdBytes:   c.SessionIdBytes,
+	}, nil
+}
+
+// Returns all shared directories with the global options filled in where a
+// share doesn't set its own. Shares with options come first so they win over
+// plain entries for the same directory.
+func (c Config) shares() []ShareConfig {
+	shares := make([]ShareConfig, 0, len(c.Shares)+len(c.ShareDirs))
+	for _, share := range c.Shares {
+		if share.Symlinks == "" {
+			share.Symlinks = c.Symlinks
+		}
+		if share.ShowHidden == nil {
+			share.ShowHidden = &c.ShowHidden
+		}
+		if share.IgnoreFiles == nil {
+			share.IgnoreFiles = &c.IgnoreFiles
+		}
+		shares = append(shares, share)
+	}
+
+	for _, dir := range c.ShareDirs {
+		shares = append(shares, ShareConfig{
+			Path:        dir,
+			Symlinks:    c.Symlinks,
+			ShowHidden:  &c.ShowHidden,
+			IgnoreFiles: &c.IgnoreFiles,
+		})
+	}
+
+	return shares
+}
+
+// Flag value collecting every occurrence of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (c IdentityConfig) identity() data.Identity {
+	return data.Identity{Alias: c.Alias, Secret: c.SecretHash}
+}
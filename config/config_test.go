@@ -0,0 +1,181 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/services"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "filete.toml")
+	err := os.WriteFile(configPath, []byte(`
+port = 9000
+bind = "127.0.0.1"
+upload-dir = "/srv/uploads"
+share = ["/srv/a"]
+session-key = "from-file"
+
+[[session-keys]]
+key = "drop-off"
+role = "uploader"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"FILETE_PORT":        "9001",
+		"FILETE_SESSION_KEY": "from-env",
+	}
+
+	c, err := load([]string{"--config", configPath, "--port", "9002", "--share", "/srv/b", "/srv/c"},
+		func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	expected := Config{
+		Port:         9002,
+		Bind:         "127.0.0.1",
+		CertFile:     DefaultCertFile,
+		KeyFile:      DefaultKeyFile,
+		UploadDir:    "/srv/uploads",
+		ShareDirs:    []string{"/srv/a", "/srv/b", "/srv/c"},
+		Symlinks:     "follow",
+		IgnoreFiles:  true,
+		SessionKey:   "from-env",
+		SessionKeys:  []SessionKeyConfig{{Key: "drop-off", Role: "uploader"}},
+		MessageStore: "file",
+		MessageFsync: "always",
+		SessionStore: "memory",
+		// Defaults
+		SessionKeyGroups: 3,
+		SessionIdBytes:   32,
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("Expected:\n%+v\nGot:\n%+v", expected, c)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "filete.json")
+	err := os.WriteFile(configPath, []byte(`{"prot": 9000}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = load([]string{"--config", configPath}, func(string) string { return "" })
+	if err == nil {
+		t.Fatal("Expected an error for unknown config key")
+	}
+}
+
+func TestValidateSessionKeys(t *testing.T) {
+	c := Default()
+	c.SelfSigned = true
+	c.UploadDir = t.TempDir()
+	c.SessionKey = "admin"
+
+	c.SessionKeys = []SessionKeyConfig{{Key: "view", Role: "viewer"}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected a valid config. Got %v", err)
+	}
+
+	for _, keys := range [][]SessionKeyConfig{
+		{{Key: "view", Role: "guest"}},
+		{{Key: "", Role: "viewer"}},
+		{{Key: "admin", Role: "viewer"}},
+	} {
+		c.SessionKeys = keys
+		if err := c.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", keys)
+		}
+	}
+}
+
+func TestSessionEntropy(t *testing.T) {
+	env := map[string]string{"FILETE_SESSION_ID_BYTES": "24"}
+	c, err := load([]string{"--session-key-groups", "4"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SelfSigned = true
+	c.UploadDir = t.TempDir()
+
+	server, err := c.ServerConfigs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.SessionKeyGroups != 4 || server.SessionIdBytes != 24 {
+		t.Fatalf("Expected 4 key groups and 24 id bytes. Got %d and %d", server.SessionKeyGroups, server.SessionIdBytes)
+	}
+
+	c.SessionKeyGroups = services.MinSessionKeyGroups - 1
+	if err := c.Validate(); err == nil {
+		t.Fatal("Expected too few key groups to be rejected")
+	}
+	c.SessionKeyGroups = services.MinSessionKeyGroups
+	c.SessionIdBytes = services.MinSessionIdBytes - 1
+	if err := c.Validate(); err == nil {
+		t.Fatal("Expected too few id bytes to be rejected")
+	}
+}
+
+func TestValidateIdentities(t *testing.T) {
+	c := Default()
+	c.SelfSigned = true
+	c.UploadDir = t.TempDir()
+
+	hash, err := services.HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Identities = []IdentityConfig{{Alias: "alice", SecretHash: hash}}
+	server, err := c.ServerConfigs(nil)
+	if err != nil {
+		t.Fatalf("Expected a valid config. Got %v", err)
+	}
+	if !reflect.DeepEqual(server.Identities, []data.Identity{{Alias: "alice", Secret: hash}}) {
+		t.Fatalf("Expected the configured identity. Got %+v", server.Identities)
+	}
+
+	for _, identities := range [][]IdentityConfig{
+		{{Alias: "alice", SecretHash: "secret"}},
+		{{Alias: "", SecretHash: hash}},
+		{{Alias: "alice", SecretHash: hash}, {Alias: "Alice", SecretHash: hash}},
+	} {
+		c.Identities = identities
+		if err := c.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", identities)
+		}
+	}
+}
+
+func TestServerConfigsShareAccess(t *testing.T) {
+	c := Default()
+	c.SelfSigned = true
+	c.UploadDir = t.TempDir()
+	share := t.TempDir()
+	c.Shares = []ShareConfig{{Path: share, AllowRoles: []string{"contributor"}, AllowIdentities: []string{"alice"}}}
+
+	server, err := c.ServerConfigs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := server.ShareDirs[0]
+	if !reflect.DeepEqual(dir.AllowedRoles, []services.Role{services.RoleContributor}) ||
+		!reflect.DeepEqual(dir.AllowedAliases, []string{"alice"}) {
+		t.Fatalf("Expected the access list of the share. Got %+v", dir)
+	}
+
+	c.Shares[0].AllowRoles = []string{"everyone"}
+	if _, err := c.ServerConfigs(nil); err == nil {
+		t.Fatal("Expected an invalid role to be rejected")
+	}
+}
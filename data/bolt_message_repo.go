@@ -0,0 +1,195 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var messagesBucket = []byte("messages")
+
+// Stores messages in a bbolt database, keyed by their id. Unlike
+// FileMessageRepo nothing is kept in memory, so it suits long histories.
+// Safe for concurrent use.
+type BoltMessageRepo struct {
+	db *bolt.DB
+}
+
+// Opens the database at path, creating it if it doesn't exist
+func NewBoltMessageRepo(path string) (*BoltMessageRepo, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(messagesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltMessageRepo{db: db}, nil
+}
+
+func (repo *BoltMessageRepo) Get(id MessageId) (Message, bool, error) {
+	var message Message
+	exists := false
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(messagesBucket).Get(messageKey(id))
+		if value == nil {
+			return nil
+		}
+		exists = true
+		return json.Unmarshal(value, &message)
+	})
+	if err != nil {
+		return Message{}, false, err
+	}
+
+	return message, exists, nil
+}
+
+// Returns all messages ordered by Id
+func (repo *BoltMessageRepo) GetAll() ([]Message, error) {
+	messages := make([]Message, 0)
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		// Keys are big endian so the cursor walks them in id order
+		return tx.Bucket(messagesBucket).ForEach(func(_, value []byte) error {
+			var message Message
+			if err := json.Unmarshal(value, &message); err != nil {
+				return err
+			}
+			messages = append(messages, message)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Starts reading right after query.AfterId and stops once query.Limit
+// messages matched, so paging doesn't decode the whole history
+func (repo *BoltMessageRepo) Query(query MessageQuery) ([]Message, error) {
+	messages := make([]Message, 0)
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(messagesBucket).Cursor()
+		for key, value := cursor.Seek(messageKey(query.AfterId + 1)); key != nil; key, value = cursor.Next() {
+			var message Message
+			if err := json.Unmarshal(value, &message); err != nil {
+				return err
+			}
+			if !query.Matches(message) {
+				continue
+			}
+
+			messages = append(messages, message)
+			if query.Limit > 0 && len(messages) == query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Messages without an Id get the next free one. Messages with an Id keep it,
+// e.g. when importing, and DuplicateEntryError is returned if it is taken.
+func (repo *BoltMessageRepo) Add(message Message) (Message, error) {
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		message, err = addMessage(tx.Bucket(messagesBucket), message)
+		return err
+	})
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// Same as Add for every message but atomic: nothing is added if adding any of
+// the messages fails.
+func (repo *BoltMessageRepo) AddAll(messages []Message) error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket)
+		for _, message := range messages {
+			if _, err := addMessage(bucket, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func addMessage(bucket *bolt.Bucket, message Message) (Message, error) {
+	if message.Id == 0 {
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return Message{}, err
+		}
+		message.Id = MessageId(id)
+	} else {
+		if bucket.Get(messageKey(message.Id)) != nil {
+			return Message{}, &DuplicateEntryError[MessageId]{duplicateKey: message.Id}
+		}
+		// Ids are never reused, even after deleting
+		if uint64(message.Id) > bucket.Sequence() {
+			if err := bucket.SetSequence(uint64(message.Id)); err != nil {
+				return Message{}, err
+			}
+		}
+	}
+
+	value, err := json.Marshal(message)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := bucket.Put(messageKey(message.Id), value); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// Deleting a message that doesn't exist is a no-op
+func (repo *BoltMessageRepo) Delete(id MessageId) error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).Delete(messageKey(id))
+	})
+}
+
+// Ids of deleted messages are not reused
+func (repo *BoltMessageRepo) DeleteAll() error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		sequence := tx.Bucket(messagesBucket).Sequence()
+		if err := tx.DeleteBucket(messagesBucket); err != nil {
+			return err
+		}
+
+		bucket, err := tx.CreateBucket(messagesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.SetSequence(sequence)
+	})
+}
+
+func (repo *BoltMessageRepo) Close() error {
+	return repo.db.Close()
+}
+
+func messageKey(id MessageId) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func initNewBoltRepo(t *testing.T) *BoltMessageRepo {
+	repo, err := NewBoltMessageRepo(filepath.Join(t.TempDir(), MessageDatabaseName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestBoltAddAndGet(t *testing.T) {
+	repo := initNewBoltRepo(t)
+
+	first, err := repo.Add(Message{Body: "first", TimeSent: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id != 1 {
+		t.Fatalf("Expected id 1. Got %d", first.Id)
+	}
+
+	// Explicit ids are kept and move the sequence forward
+	if _, err := repo.Add(Message{Id: 300, Body: "imported"}); err != nil {
+		t.Fatal(err)
+	}
+	next, err := repo.Add(Message{Body: "next"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Id != 301 {
+		t.Fatalf("Expected id 301. Got %d", next.Id)
+	}
+
+	_, err = repo.Add(Message{Id: 300, Body: "duplicate"})
+	var duplicate *DuplicateEntryError[MessageId]
+	if !errors.As(err, &duplicate) {
+		t.Fatalf("Expected DuplicateEntryError. Got %v", err)
+	}
+
+	message, exists, err := repo.Get(first.Id)
+	if err != nil || !exists || !reflect.DeepEqual(message, first) {
+		t.Fatalf("Expected %+v. Got %+v, %v, %v", first, message, exists, err)
+	}
+
+	messages, err := repo.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || messages[0].Id != 1 || messages[1].Id != 300 || messages[2].Id != 301 {
+		t.Fatalf("Expected messages ordered by id. Got %+v", messages)
+	}
+}
+
+func TestBoltAddAllIsAtomic(t *testing.T) {
+	repo := initNewBoltRepo(t)
+
+	if _, err := repo.Add(Message{Id: 2, Body: "taken"}); err != nil {
+		t.Fatal(err)
+	}
+	err := repo.AddAll([]Message{{Id: 1, Body: "new"}, {Id: 2, Body: "duplicate"}})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if _, exists, _ := repo.Get(1); exists {
+		t.Fatal("Expected no message to be added")
+	}
+}
+
+func TestBoltDeleteAllKeepsSequence(t *testing.T) {
+	repo := initNewBoltRepo(t)
+
+	if err := repo.AddAll([]Message{{Body: "a"}, {Body: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, _ := repo.GetAll()
+	if len(messages) != 0 {
+		t.Fatalf("Expected no messages. Got %+v", messages)
+	}
+	message, err := repo.Add(Message{Body: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != 3 {
+		t.Fatalf("Expected id 3. Got %d", message.Id)
+	}
+}
+
+func TestMigrateMessages(t *testing.T) {
+	dir := t.TempDir()
+	source, err := NewFileMessageRepo(filepath.Join(dir, MessageFileName), FileMessageRepoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if err := source.AddAll([]Message{{Body: "a"}, {Body: "b"}, {Body: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	source.Delete(2)
+
+	destination := initNewBoltRepo(t)
+	for run, expected := range []int{2, 0} {
+		copied, skipped, err := MigrateMessages(source, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied != expected || skipped != 2-expected {
+			t.Fatalf("Run %d: expected %d copied. Got %d copied, %d skipped", run, expected, copied, skipped)
+		}
+	}
+
+	messages, _ := destination.GetAll()
+	if len(messages) != 2 || messages[0].Id != 1 || messages[1].Id != 3 {
+		t.Fatalf("Expected messages 1 and 3. Got %+v", messages)
+	}
+}
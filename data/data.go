@@ -6,13 +6,15 @@ type Getter[K, T any] interface {
 }
 
 type Adder[K, T any] interface {
-	Add(item T) error
+	// Returns the item as it was stored, e.g. with a generated key
+	Add(item T) (T, error)
 	AddAll(items []T) error
 }
 
 type Deleter[K, T any] interface {
-	Delete(key K)
-	DeleteAll()
+	// Deleting a key that doesn't exist is not an error
+	Delete(key K) error
+	DeleteAll() error
 }
 
 type Repository[K, T any] interface {
@@ -3,198 +3,543 @@ package data
 import (
 	"bytes"
 	"encoding/json"
-	"github.com/sunkit02/filete/logging"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sunkit02/filete/logging"
+)
+
+// When the message file is synced to disk
+type FsyncPolicy string
+
+const (
+	// Sync after every write. Nothing acknowledged is lost on power loss.
+	FsyncAlways FsyncPolicy = "always"
+	// Sync in the background every FileMessageRepoOptions.FsyncInterval
+	FsyncInterval FsyncPolicy = "interval"
+	// Leave syncing to the operating system
+	FsyncNever FsyncPolicy = "never"
+)
+
+const (
+	DefaultFsyncPolicy   = FsyncAlways
+	DefaultFsyncInterval = 1 * time.Second
+	// Number of obsolete lines, i.e. deleted messages and tombstones, after
+	// which the file is compacted if they also outnumber the live messages
+	DefaultCompactionThreshold = 1000
 )
 
+type FileMessageRepoOptions struct {
+	// Defaults to DefaultFsyncPolicy
+	Fsync FsyncPolicy
+	// Defaults to DefaultFsyncInterval
+	FsyncInterval time.Duration
+	// Defaults to DefaultCompactionThreshold
+	CompactionThreshold int
+	// Only reads an existing file, e.g. to migrate it, leaving a partially
+	// written last line in place. Writes fail with ErrReadOnly.
+	ReadOnly bool
+}
+
+var ErrReadOnly = errors.New("Message file is opened read-only")
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch policy := FsyncPolicy(s); policy {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return policy, nil
+	case "":
+		return DefaultFsyncPolicy, nil
+	default:
+		return "", fmt.Errorf("Invalid fsync policy '%s'. Must be one of always, interval or never", s)
+	}
+}
+
+// Operations of records other than messages in the message file
+const (
+	// Deletes the message with the record's id
+	opDelete = "del"
+	// Deletes every message
+	opClear = "clear"
+	// Sets the id of the last message ever added, written at the start of
+	// compacted files so ids of deleted messages are not reused
+	opSequence = "seq"
+)
+
+// A line of the message file. Lines without an op are messages.
+type logRecord struct {
+	Op string    `json:"op,omitempty"`
+	Id MessageId `json:"id"`
+}
+
+// Stores messages in an append-only log of JSON lines. Deletes append
+// tombstone records and the log is compacted in the background once it
+// contains mostly obsolete lines. All messages are kept in memory as well.
+// Safe for concurrent use.
 type FileMessageRepo struct {
+	options FileMessageRepoOptions
+
+	// Guards every field below
+	lock             sync.RWMutex
 	path             string
 	file             *os.File
 	nextId           MessageId
 	messageReadCache map[MessageId]Message
+	// Lines of the file that don't contribute to the current state
+	obsoleteLines int
+	compacting    bool
+	dirty         bool
+	closed        bool
+
+	stopSync   chan struct{}
+	background sync.WaitGroup
 }
 
-func NewFileMessageRepo(path string) FileMessageRepo {
-	return FileMessageRepo{path: path}
+// Opens the message file at path, creating it if it doesn't exist, and loads
+// all messages stored in it. A partially written last line, e.g. after a
+// crash, is dropped, see FileMessageRepoOptions.ReadOnly.
+func NewFileMessageRepo(path string, options FileMessageRepoOptions) (*FileMessageRepo, error) {
+	policy, err := ParseFsyncPolicy(string(options.Fsync))
+	if err != nil {
+		return nil, err
+	}
+	options.Fsync = policy
+	if options.FsyncInterval <= 0 {
+		options.FsyncInterval = DefaultFsyncInterval
+	}
+	if options.CompactionThreshold <= 0 {
+		options.CompactionThreshold = DefaultCompactionThreshold
+	}
+
+	repo := &FileMessageRepo{path: path, options: options}
+	if err := repo.populateCache(); err != nil {
+		return nil, err
+	}
+
+	if options.Fsync == FsyncInterval && !options.ReadOnly {
+		repo.stopSync = make(chan struct{})
+		repo.background.Add(1)
+		go repo.syncPeriodically()
+	}
+
+	return repo, nil
 }
 
 func (repo *FileMessageRepo) Get(id MessageId) (Message, bool, error) {
-	if repo.messageReadCache == nil {
-		repo.populateCache()
-	}
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
 
 	if message, exists := repo.messageReadCache[id]; exists {
-		return message, true, nil
+		return message.clone(), true, nil
 	} else {
 		return Message{}, false, nil
 	}
 }
 
+// Returns all messages ordered by Id
 func (repo *FileMessageRepo) GetAll() ([]Message, error) {
-	if repo.messageReadCache == nil {
-		repo.populateCache()
-	}
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
 
 	// Create new copy of data independent of cached values
 	messages := make([]Message, 0, len(repo.messageReadCache))
 	for _, message := range repo.messageReadCache {
-		messages = append(messages, Message{
-			Id:       message.Id,
-			Body:     message.Body,
-			TimeSent: message.TimeSent,
-		})
+		messages = append(messages, message.clone())
 	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Id < messages[j].Id
+	})
 	return messages, nil
 }
 
-// Returns DuplicateEntryError if there is a duplicate key entry exists
-// NOTE: This repo automatically overrides the Id field of Message.
-func (repo *FileMessageRepo) Add(message Message) error {
-	// TODO: Extract this out and have a safe Add func that checks this and an
-	// internal unsafe add that gets called by the safe Add after the check
-	if repo.messageReadCache == nil {
-		repo.populateCache()
+func (repo *FileMessageRepo) Query(query MessageQuery) ([]Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	return filterMessages(repo.messageReadCache, query), nil
+}
+
+// Messages without an Id get the next free one. Messages with an Id keep it,
+// e.g. when importing, and DuplicateEntryError is returned if it is taken.
+// The stored message is returned.
+func (repo *FileMessageRepo) Add(message Message) (Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	return repo.add(message)
+}
+
+// Must be called with the lock held
+func (repo *FileMessageRepo) add(message Message) (Message, error) {
+	if message.Id == 0 {
+		message.Id = repo.nextId + 1
+	} else if _, exists := repo.messageReadCache[message.Id]; exists {
+		return Message{}, &DuplicateEntryError[MessageId]{duplicateKey: message.Id}
 	}
 
-	repo.nextId++
-	message.Id = repo.nextId
 	err := repo.appendToFile(message)
 	if err != nil {
-		return nil
+		return Message{}, err
 	}
 
-	repo.messageReadCache[message.Id] = message
+	// Ids are never reused, even after deleting
+	if message.Id > repo.nextId {
+		repo.nextId = message.Id
+	}
+	repo.messageReadCache[message.Id] = message.clone()
 
-	return nil
+	return message, nil
 }
 
-// Returns DuplicateEntryError if there is a duplicate key entry exists.
-// This method is atomic and aborts if there is a single duplicate entry
-// NOTE: This repo automatically overrides the Id field of Message.
+// Same as Add for every message. Returns DuplicateEntryError without adding
+// anything if any of the ids is taken.
 func (repo *FileMessageRepo) AddAll(messages []Message) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err := checkDuplicateIds(messages, repo.messageReadCache); err != nil {
+		return err
+	}
+
 	for _, message := range messages {
-		repo.Add(message)
+		if _, err := repo.add(message); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (repo *FileMessageRepo) Delete(id MessageId) {
-	if repo.messageReadCache == nil {
-		repo.populateCache()
+// Returns DuplicateEntryError if any of the non-zero ids of messages appears
+// twice or is already used in existing
+func checkDuplicateIds(messages []Message, existing map[MessageId]Message) error {
+	seen := make(map[MessageId]bool, len(messages))
+	for _, message := range messages {
+		if message.Id == 0 {
+			continue
+		}
+		if _, exists := existing[message.Id]; exists || seen[message.Id] {
+			return &DuplicateEntryError[MessageId]{duplicateKey: message.Id}
+		}
+		seen[message.Id] = true
 	}
 
-	if _, exists := repo.messageReadCache[id]; exists {
-		delete(repo.messageReadCache, id)
-		repo.file.Close()
-		_ = os.Truncate(repo.path, 0)
+	return nil
+}
 
-		file, err := os.OpenFile(repo.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			log.Fatal("Failed to open file: ", err)
-		}
-		repo.file = file
+// Deleting a message that doesn't exist is a no-op
+func (repo *FileMessageRepo) Delete(id MessageId) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
-		for _, message := range repo.messageReadCache {
-			err := repo.appendToFile(message)
-			if err != nil {
-				logging.Error.Fatal("Failed to write back to file after deletion, possible data corruption.")
-			}
-		}
+	if _, exists := repo.messageReadCache[id]; !exists {
+		return nil
+	}
 
+	if err := repo.appendToFile(logRecord{Op: opDelete, Id: id}); err != nil {
+		return err
 	}
+
+	delete(repo.messageReadCache, id)
+	// The message and its tombstone
+	repo.obsoleteLines += 2
+	repo.maybeCompact()
+
+	return nil
 }
 
-func (repo *FileMessageRepo) DeleteAll() {
-	if repo.messageReadCache != nil {
-		repo.messageReadCache = nil
-		repo.file.Close()
+// Ids of deleted messages are not reused
+func (repo *FileMessageRepo) DeleteAll() error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err := repo.appendToFile(logRecord{Op: opClear}); err != nil {
+		return err
 	}
 
-	os.Truncate(repo.path, 0)
+	repo.obsoleteLines += len(repo.messageReadCache) + 1
+	repo.messageReadCache = make(map[MessageId]Message)
+	repo.maybeCompact()
+
+	return nil
 }
 
-func (repo *FileMessageRepo) populateCache() {
-	if repo.file == nil {
-		file, err := os.OpenFile(repo.path, os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			logging.Error.Fatal("Failed to open file: ", err)
-		}
-		repo.file = file
+// Waits for background work to finish, syncs and closes the file. The repo
+// can't be used afterwards.
+func (repo *FileMessageRepo) Close() error {
+	repo.lock.Lock()
+	if repo.closed {
+		repo.lock.Unlock()
+		return nil
 	}
+	repo.closed = true
+	if repo.stopSync != nil {
+		close(repo.stopSync)
+	}
+	repo.lock.Unlock()
+
+	repo.background.Wait()
 
-	messages, err := parseMessagesFromFile(repo.file)
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	var syncErr error
+	if !repo.options.ReadOnly {
+		syncErr = repo.file.Sync()
+	}
+	if err := repo.file.Close(); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+func (repo *FileMessageRepo) populateCache() error {
+	flags := os.O_APPEND | os.O_CREATE | os.O_RDWR
+	if repo.options.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := os.OpenFile(repo.path, flags, 0644)
 	if err != nil {
-		logging.Error.Printf("error reading from message file: %v\n", err)
+		return err
 	}
-	messageMap := make(map[MessageId]Message, len(messages))
-	for _, message := range messages {
-		messageMap[message.Id] = message
-		if message.Id > repo.nextId {
-			repo.nextId = message.Id
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading from message file: %w", err)
+	}
+
+	// Anything after the last newline is a write that didn't complete
+	if end := bytes.LastIndexByte(content, '\n') + 1; end < len(content) && repo.options.ReadOnly {
+		logging.Warning.Printf("Ignoring partially written last line of %s: '%s'", repo.path, content[end:])
+		content = content[:end]
+	} else if end < len(content) {
+		logging.Warning.Printf("Dropping partially written last line of %s: '%s'", repo.path, content[end:])
+		if err := file.Truncate(int64(end)); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to drop partially written line: %w", err)
 		}
+		content = content[:end]
 	}
-	repo.messageReadCache = messageMap
+
+	repo.file = file
+	repo.messageReadCache = make(map[MessageId]Message)
+	repo.replay(content)
+
+	return nil
 }
 
-func (repo *FileMessageRepo) appendToFile(message Message) error {
-	if repo.file == nil {
-		file, err := os.OpenFile(repo.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			logging.Error.Fatal("Failed to open file: ", err)
+// Applies the records of a message file to the cache
+func (repo *FileMessageRepo) replay(content []byte) {
+	lines := bytes.Split(content, []byte{'\n'})
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logging.Error.Printf("Failed to parse line %d of %s: '%s'", i+1, repo.path, line)
+			repo.obsoleteLines++
+			continue
+		}
+
+		switch record.Op {
+		case "":
+			var message Message
+			if err := json.Unmarshal(line, &message); err != nil {
+				logging.Error.Printf("Failed to unmarshal Message. Line %d: '%s'", i+1, line)
+				repo.obsoleteLines++
+				continue
+			}
+			if _, exists := repo.messageReadCache[message.Id]; exists {
+				repo.obsoleteLines++
+			}
+			repo.messageReadCache[message.Id] = message
+		case opDelete:
+			if _, exists := repo.messageReadCache[record.Id]; exists {
+				delete(repo.messageReadCache, record.Id)
+				repo.obsoleteLines++
+			}
+			repo.obsoleteLines++
+		case opClear:
+			repo.obsoleteLines += len(repo.messageReadCache) + 1
+			repo.messageReadCache = make(map[MessageId]Message)
+		case opSequence:
+		default:
+			logging.Error.Printf("Unknown operation '%s' on line %d of %s", record.Op, i+1, repo.path)
+			repo.obsoleteLines++
+			continue
+		}
+
+		if record.Id > repo.nextId {
+			repo.nextId = record.Id
 		}
-		repo.file = file
 	}
+}
 
-	bytes, err := json.Marshal(message)
-	if err != nil {
-		logging.Error.Fatal("Failed to marshal Message:", err)
+// Appends a record as one line. Must be called with the lock held.
+func (repo *FileMessageRepo) appendToFile(record any) error {
+	if repo.closed {
+		return os.ErrClosed
+	}
+	if repo.options.ReadOnly {
+		return ErrReadOnly
 	}
 
-	_, err = repo.file.Seek(0, io.SeekEnd)
+	line, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
+	line = append(line, '\n')
 
-	_, err = repo.file.Write(bytes)
+	// A single write so a crash can at most leave a partial last line
+	if _, err := repo.file.Write(line); err != nil {
+		return err
+	}
 
-	if err != nil {
+	if repo.options.Fsync == FsyncAlways {
+		return repo.file.Sync()
+	}
+	repo.dirty = true
+	return nil
+}
+
+// Starts a compaction in the background if enough of the file is obsolete.
+// Must be called with the lock held.
+func (repo *FileMessageRepo) maybeCompact() {
+	if repo.compacting || repo.closed ||
+		repo.obsoleteLines < repo.options.CompactionThreshold ||
+		repo.obsoleteLines < len(repo.messageReadCache) {
+		return
+	}
+
+	repo.compacting = true
+	repo.background.Add(1)
+	go func() {
+		defer repo.background.Done()
+		// Closing the repo first is fine, the log stays valid
+		if err := repo.Compact(); err != nil && !errors.Is(err, os.ErrClosed) {
+			logging.Error.Printf("Failed to compact %s: %v", repo.path, err)
+		}
+	}()
+}
+
+// Rewrites the file with only the live messages. The new file is written next
+// to the old one and renamed over it, so either is complete at any time.
+func (repo *FileMessageRepo) Compact() error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	defer func() { repo.compacting = false }()
+
+	if repo.closed {
+		return os.ErrClosed
+	}
+	if repo.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	ids := make([]MessageId, 0, len(repo.messageReadCache))
+	for id := range repo.messageReadCache {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	if err := encoder.Encode(logRecord{Op: opSequence, Id: repo.nextId}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := encoder.Encode(repo.messageReadCache[id]); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := repo.path + ".tmp"
+	if err := writeFileSynced(tmpPath, buffer.Bytes()); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	_, err = repo.file.WriteString("\n")
+	if err := os.Rename(tmpPath, repo.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(repo.path))
+
+	file, err := os.OpenFile(repo.path, os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
+		// The old file is gone, writes can't continue safely
+		repo.closed = true
 		return err
 	}
+	repo.file.Close()
+	repo.file = file
+	repo.obsoleteLines = 0
+	repo.dirty = false
 
 	return nil
 }
 
-func parseMessagesFromFile(file *os.File) ([]Message, error) {
-	bytesRead, err := io.ReadAll(file)
+func (repo *FileMessageRepo) syncPeriodically() {
+	defer repo.background.Done()
+
+	ticker := time.NewTicker(repo.options.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-repo.stopSync:
+			return
+		case <-ticker.C:
+			repo.lock.Lock()
+			if repo.dirty && !repo.closed {
+				if err := repo.file.Sync(); err != nil {
+					logging.Error.Printf("Failed to sync %s: %v", repo.path, err)
+				} else {
+					repo.dirty = false
+				}
+			}
+			repo.lock.Unlock()
+		}
+	}
+}
+
+func writeFileSynced(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
 	}
-	messageBytesList := bytes.Split(bytesRead, []byte{'\n'})
-	messages := make([]Message, 0, len(messageBytesList))
+	return file.Close()
+}
 
-	for i, messageBytes := range messageBytesList {
-		if len(messageBytes) == 0 {
-			continue
-		}
-		var message Message
-		err := json.Unmarshal(messageBytes, &message)
-		if err != nil {
-			logging.Error.Printf("Failed to unmarshal Message. Line %d: '%s'", i+1, string(messageBytes))
-			continue
-		}
-		messages = append(messages, message)
+// Makes a rename in the directory durable. Not supported on every platform,
+// so failures are only logged.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		logging.Debug.Printf("Failed to open %s for syncing: %v", path, err)
+		return
 	}
+	defer dir.Close()
 
-	return messages, nil
+	if err := dir.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		logging.Debug.Printf("Failed to sync %s: %v", path, err)
+	}
 }
 
 type UploadedFilesRepo struct {
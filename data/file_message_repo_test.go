@@ -3,10 +3,13 @@ package data
 import (
 	"bytes"
 	"encoding/json"
-	"github.com/sunkit02/filete/logging"
+	"errors"
 	"fmt"
+	"github.com/sunkit02/filete/logging"
 	"math/rand"
 	"os"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,10 +20,14 @@ func init() {
 	logging.InitializeLoggers(os.Stdout)
 }
 
-func initNewFileRepo() FileMessageRepo {
+func initNewFileRepo() *FileMessageRepo {
 	dataFilePath := fmt.Sprintf("%s-%d.dat", testFilePath, rand.Uint64())
 
-	return NewFileMessageRepo(dataFilePath)
+	repo, err := NewFileMessageRepo(dataFilePath, FileMessageRepoOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return repo
 }
 
 func TestAdd(t *testing.T) {
@@ -89,7 +96,7 @@ func TestGet(t *testing.T) {
 			t.Log("Error:", err)
 			t.FailNow()
 		}
-		if message != expected {
+		if !reflect.DeepEqual(message, expected) {
 			t.Logf("Assertion Error:\nExpected:\n%v\nGot:\n%v", expected, message)
 			t.FailNow()
 		}
@@ -155,7 +162,7 @@ func TestDelete(t *testing.T) {
 		t.FailNow()
 	}
 
-	if messages2[0] != messages1[1] {
+	if !reflect.DeepEqual(messages2[0], messages1[1]) {
 		t.Logf("Expected:\n%+v\nGot:\n%+v\n", messages1[1], messages2[0])
 		t.FailNow()
 	}
@@ -202,30 +209,315 @@ func TestDeleteAll(t *testing.T) {
 	}
 }
 
-func slicesEqual[t comparable](s1, s2 []t) bool {
+func slicesEqual[T any](s1, s2 []T) bool {
 	if len(s1) != len(s2) {
 		return false
 	}
 
-	m1 := make(map[t]bool)
-	m2 := make(map[t]bool)
-
-	mapsEqual(m1, m2)
+	// Match every element of s1 with a different equal element of s2,
+	// ignoring order
+	matched := make([]bool, len(s2))
+	for i := range s1 {
+		found := false
+		for j := range s2 {
+			if !matched[j] && reflect.DeepEqual(s1[i], s2[j]) {
+				matched[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
 
 	return true
 }
 
-// Checks for equality between two maps
-func mapsEqual[K comparable, V comparable](m1, m2 map[K]V) bool {
-	if len(m1) != len(m2) {
-		return false
+func TestAddReturnsStoredMessage(t *testing.T) {
+	repo := initNewFileRepo()
+
+	for i := 1; i <= 20; i++ {
+		message, err := repo.Add(Message{Body: fmt.Sprint(i), TimeSent: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Id != MessageId(i) {
+			t.Fatalf("Expected id %d. Got %d", i, message.Id)
+		}
 	}
 
-	for key, value := range m1 {
-		if v, ok := m2[key]; !ok || v != value {
-			return false
+	messages, err := repo.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, message := range messages {
+		if message.Id != MessageId(i+1) {
+			t.Fatalf("Expected messages ordered by id. Got %v", messages)
 		}
 	}
+}
 
-	return true
+func TestConcurrentAdd(t *testing.T) {
+	repo := initNewFileRepo()
+
+	const workers, perWorker = 16, 50
+	ids := make(chan MessageId, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				message, err := repo.Add(Message{Body: "concurrent", TimeSent: time.Now().UTC()})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- message.Id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[MessageId]bool, workers*perWorker)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("Duplicate message id %d", id)
+		}
+		seen[id] = true
+	}
+
+	// Every message must have been written as a whole line
+	reopened, err := NewFileMessageRepo(repo.path, FileMessageRepoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := reopened.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != workers*perWorker {
+		t.Fatalf("Expected %d messages after reopening. Got %d", workers*perWorker, len(messages))
+	}
+}
+
+func TestConcurrentAddGetDelete(t *testing.T) {
+	repo := initNewFileRepo()
+
+	const workers, perWorker = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				message, err := repo.Add(Message{Body: "short lived", TimeSent: time.Now().UTC()})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, exists, err := repo.Get(message.Id); err != nil || !exists {
+					t.Errorf("Message %d not found after adding: %v", message.Id, err)
+					return
+				}
+				if _, err := repo.GetAll(); err != nil {
+					t.Error(err)
+					return
+				}
+				repo.Delete(message.Id)
+				if _, exists, _ := repo.Get(message.Id); exists {
+					t.Errorf("Message %d found after deleting", message.Id)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages, err := repo.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("Expected all messages to be deleted. Got %d", len(messages))
+	}
+}
+
+func TestDeletesSurviveReopening(t *testing.T) {
+	repo := initNewFileRepo()
+
+	err := repo.AddAll([]Message{{Body: "a"}, {Body: "b"}, {Body: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileMessageRepo(repo.path, FileMessageRepoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := reopened.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Body != "a" || messages[1].Body != "c" {
+		t.Fatalf("Expected messages a and c. Got %+v", messages)
+	}
+
+	if err := reopened.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	message, err := reopened.Add(Message{Body: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != 4 {
+		t.Fatalf("Expected ids of deleted messages not to be reused. Got %d", message.Id)
+	}
+}
+
+func TestTornLastLineIsDropped(t *testing.T) {
+	repo := initNewFileRepo()
+	if _, err := repo.Add(Message{Body: "complete"}); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	file, err := os.OpenFile(repo.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":2,"body":"torn`)
+	file.Close()
+
+	reopened, err := NewFileMessageRepo(repo.path, FileMessageRepoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := reopened.Add(Message{Body: "after crash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != 2 {
+		t.Fatalf("Expected id 2. Got %d", message.Id)
+	}
+	reopened.Close()
+
+	// The new message must not be glued to the torn line
+	again, err := NewFileMessageRepo(repo.path, FileMessageRepoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := again.GetAll()
+	if len(messages) != 2 || messages[1].Body != "after crash" {
+		t.Fatalf("Unexpected messages after recovery %+v", messages)
+	}
+}
+
+func TestReadOnlyRepoLeavesFileAsIs(t *testing.T) {
+	repo := initNewFileRepo()
+	if _, err := repo.Add(Message{Body: "complete"}); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	file, err := os.OpenFile(repo.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":2,"body":"torn`)
+	file.Close()
+	before, err := os.ReadFile(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly, err := NewFileMessageRepo(repo.path, FileMessageRepoOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := readOnly.GetAll()
+	if len(messages) != 1 || messages[0].Body != "complete" {
+		t.Fatalf("Expected only the complete message. Got %+v", messages)
+	}
+	if _, err := readOnly.Add(Message{Body: "write"}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly. Got %v", err)
+	}
+	if err := readOnly.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadFile(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("Expected the file to be unchanged. Got %q", after)
+	}
+
+	missing := repo.path + ".missing"
+	if _, err := NewFileMessageRepo(missing, FileMessageRepoOptions{ReadOnly: true}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist. Got %v", err)
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Expected the missing file not to be created")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	repo, err := NewFileMessageRepo(
+		fmt.Sprintf("%s-%d.dat", testFilePath, rand.Uint64()),
+		FileMessageRepoOptions{Fsync: FsyncNever, CompactionThreshold: 10},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		message, err := repo.Add(Message{Body: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%4 != 0 {
+			if err := repo.Delete(message.Id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	content, err := os.ReadFile(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sequence record and the 5 remaining messages
+	if lines := bytes.Count(content, []byte{'\n'}); lines != 6 {
+		t.Fatalf("Expected 6 lines after compaction. Got %d:\n%s", lines, content)
+	}
+
+	reopened, err := NewFileMessageRepo(repo.path, FileMessageRepoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := reopened.GetAll()
+	if len(messages) != 5 || messages[4].Id != 17 {
+		t.Fatalf("Unexpected messages after compaction %+v", messages)
+	}
+	message, err := reopened.Add(Message{Body: "next"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != 21 {
+		t.Fatalf("Expected id 21 after compaction. Got %d", message.Id)
+	}
 }
@@ -0,0 +1,133 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the file of the identity store inside the data directory
+const IdentityFileName = "identities.json"
+
+// Stores registered identities in a JSON file, keyed by their alias ignoring
+// case. The whole file is rewritten on every change, which is fine for the
+// handful of identities a server has. Safe for concurrent use.
+type IdentityRepo struct {
+	lock       sync.RWMutex
+	path       string
+	identities map[string]Identity
+}
+
+// Opens the identity file at path, creating it on the first Add
+func NewIdentityRepo(path string) (*IdentityRepo, error) {
+	repo := &IdentityRepo{path: path, identities: make(map[string]Identity)}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return repo, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var identities []Identity
+	if err := json.Unmarshal(content, &identities); err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		repo.identities[identityKey(identity.Alias)] = identity
+	}
+
+	return repo, nil
+}
+
+// Aliases are matched ignoring case
+func (repo *IdentityRepo) Get(alias string) (Identity, bool, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	identity, exists := repo.identities[identityKey(alias)]
+	return identity, exists, nil
+}
+
+// Returns all identities ordered by alias
+func (repo *IdentityRepo) GetAll() ([]Identity, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	identities := make([]Identity, 0, len(repo.identities))
+	for _, identity := range repo.identities {
+		identities = append(identities, identity)
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identityKey(identities[i].Alias) < identityKey(identities[j].Alias)
+	})
+	return identities, nil
+}
+
+// Returns DuplicateEntryError if the alias is taken
+func (repo *IdentityRepo) Add(identity Identity) (Identity, error) {
+	if err := repo.AddAll([]Identity{identity}); err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+// Returns DuplicateEntryError without adding anything if any of the aliases
+// is taken
+func (repo *IdentityRepo) AddAll(identities []Identity) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	added := make(map[string]Identity, len(repo.identities)+len(identities))
+	for key, identity := range repo.identities {
+		added[key] = identity
+	}
+	for _, identity := range identities {
+		key := identityKey(identity.Alias)
+		if _, exists := added[key]; exists {
+			return &DuplicateEntryError[string]{duplicateKey: identity.Alias}
+		}
+		added[key] = identity
+	}
+
+	if err := repo.save(added); err != nil {
+		return err
+	}
+	repo.identities = added
+	return nil
+}
+
+// Replaces the file with the given identities. Must be called with the lock
+// held.
+func (repo *IdentityRepo) save(identities map[string]Identity) error {
+	list := make([]Identity, 0, len(identities))
+	for _, identity := range identities {
+		list = append(list, identity)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return identityKey(list[i].Alias) < identityKey(list[j].Alias)
+	})
+
+	content, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := repo.path + ".tmp"
+	if err := writeFileSynced(tempPath, content); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, repo.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(repo.path))
+	return nil
+}
+
+func identityKey(alias string) string {
+	return strings.ToLower(alias)
+}
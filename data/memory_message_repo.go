@@ -0,0 +1,109 @@
+package data
+
+import (
+	"sort"
+	"sync"
+)
+
+// Keeps messages in memory only, e.g. for tests. Follows the same rules as the
+// persistent repos. Safe for concurrent use.
+type MemoryMessageRepo struct {
+	lock     sync.RWMutex
+	nextId   MessageId
+	messages map[MessageId]Message
+}
+
+func NewMemoryMessageRepo() *MemoryMessageRepo {
+	return &MemoryMessageRepo{messages: make(map[MessageId]Message)}
+}
+
+func (repo *MemoryMessageRepo) Get(id MessageId) (Message, bool, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	message, exists := repo.messages[id]
+	return message.clone(), exists, nil
+}
+
+// Returns all messages ordered by Id
+func (repo *MemoryMessageRepo) GetAll() ([]Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	messages := make([]Message, 0, len(repo.messages))
+	for _, message := range repo.messages {
+		messages = append(messages, message.clone())
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Id < messages[j].Id
+	})
+	return messages, nil
+}
+
+func (repo *MemoryMessageRepo) Query(query MessageQuery) ([]Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	return filterMessages(repo.messages, query), nil
+}
+
+// Messages without an Id get the next free one. Messages with an Id keep it
+// and DuplicateEntryError is returned if it is taken.
+func (repo *MemoryMessageRepo) Add(message Message) (Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err := checkDuplicateIds([]Message{message}, repo.messages); err != nil {
+		return Message{}, err
+	}
+	return repo.add(message), nil
+}
+
+// Same as Add for every message. Returns DuplicateEntryError without adding
+// anything if any of the ids is taken.
+func (repo *MemoryMessageRepo) AddAll(messages []Message) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err := checkDuplicateIds(messages, repo.messages); err != nil {
+		return err
+	}
+	for _, message := range messages {
+		repo.add(message)
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (repo *MemoryMessageRepo) add(message Message) Message {
+	if message.Id == 0 {
+		message.Id = repo.nextId + 1
+	}
+	if message.Id > repo.nextId {
+		repo.nextId = message.Id
+	}
+
+	repo.messages[message.Id] = message.clone()
+	return message
+}
+
+func (repo *MemoryMessageRepo) Delete(id MessageId) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	delete(repo.messages, id)
+	return nil
+}
+
+// Ids of deleted messages are not reused
+func (repo *MemoryMessageRepo) DeleteAll() error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.messages = make(map[MessageId]Message)
+	return nil
+}
+
+func (repo *MemoryMessageRepo) Close() error {
+	return nil
+}
@@ -0,0 +1,73 @@
+package data
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filters messages. Zero fields don't filter.
+type MessageQuery struct {
+	// Only messages with a greater id
+	AfterId MessageId
+	// Maximum number of messages returned
+	Limit int
+	// Every whitespace separated token has to appear in the body, ignoring case
+	Text string
+	// Exact sender alias, ignoring case
+	Sender string
+	// Only messages sent at or after Since
+	Since time.Time
+	// Only messages sent before Until
+	Until time.Time
+}
+
+// Repositories able to filter messages themselves, e.g. using an index
+type MessageQuerier interface {
+	// Returns the matching messages ordered by Id
+	Query(query MessageQuery) ([]Message, error)
+}
+
+// Reports whether message matches every filter of the query except Limit
+func (query MessageQuery) Matches(message Message) bool {
+	if message.Id <= query.AfterId {
+		return false
+	}
+	if query.Sender != "" && !strings.EqualFold(message.Sender, query.Sender) {
+		return false
+	}
+	if !query.Since.IsZero() && message.TimeSent.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !message.TimeSent.Before(query.Until) {
+		return false
+	}
+
+	body := strings.ToLower(message.Body)
+	for _, token := range strings.Fields(strings.ToLower(query.Text)) {
+		if !strings.Contains(body, token) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Applies query to messages by scanning all of them. For repositories without
+// a better way to filter.
+func filterMessages(messages map[MessageId]Message, query MessageQuery) []Message {
+	matches := make([]Message, 0)
+	for _, message := range messages {
+		if query.Matches(message) {
+			matches = append(matches, message.clone())
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Id < matches[j].Id
+	})
+
+	if query.Limit > 0 && len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+	}
+	return matches
+}
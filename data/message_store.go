@@ -0,0 +1,82 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Backend storing the messages
+type MessageStore string
+
+const (
+	// Append-only log of JSON lines, see FileMessageRepo
+	MessageStoreFile MessageStore = "file"
+	// Embedded key-value database, see BoltMessageRepo
+	MessageStoreBolt MessageStore = "bolt"
+)
+
+const DefaultMessageStore = MessageStoreFile
+
+// Names of the files of the message stores inside the data directory
+const (
+	MessageFileName     = "messages.dat"
+	MessageDatabaseName = "messages.db"
+)
+
+// A Repository of messages holding resources that have to be released
+type MessageRepository interface {
+	Repository[MessageId, Message]
+	MessageQuerier
+	io.Closer
+}
+
+func ParseMessageStore(s string) (MessageStore, error) {
+	switch store := MessageStore(s); store {
+	case MessageStoreFile, MessageStoreBolt:
+		return store, nil
+	case "":
+		return DefaultMessageStore, nil
+	default:
+		return "", fmt.Errorf("Invalid message store '%s'. Must be one of file or bolt", s)
+	}
+}
+
+// Opens the message repository of the given store inside dir. The options
+// only apply to MessageStoreFile.
+func OpenMessageRepo(store MessageStore, dir string, options FileMessageRepoOptions) (MessageRepository, error) {
+	switch store {
+	case MessageStoreFile, "":
+		return NewFileMessageRepo(filepath.Join(dir, MessageFileName), options)
+	case MessageStoreBolt:
+		return NewBoltMessageRepo(filepath.Join(dir, MessageDatabaseName))
+	default:
+		return nil, fmt.Errorf("Invalid message store '%s'", store)
+	}
+}
+
+// Copies every message of from into to, keeping their ids. Messages whose id
+// already exists in to are skipped, so an interrupted migration can be run
+// again. Returns the number of messages copied and skipped.
+func MigrateMessages(from Getter[MessageId, Message], to Adder[MessageId, Message]) (int, int, error) {
+	messages, err := from.GetAll()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	copied, skipped := 0, 0
+	for _, message := range messages {
+		_, err := to.Add(message)
+		var duplicate *DuplicateEntryError[MessageId]
+		if errors.As(err, &duplicate) {
+			skipped++
+			continue
+		} else if err != nil {
+			return copied, skipped, fmt.Errorf("failed to copy message %d: %w", message.Id, err)
+		}
+		copied++
+	}
+
+	return copied, skipped, nil
+}
@@ -0,0 +1,39 @@
+package data_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/data/repotest"
+)
+
+func TestFileMessageRepoContract(t *testing.T) {
+	repotest.RunRepositoryContract(t, func(t *testing.T) data.MessageRepository {
+		repo, err := data.NewFileMessageRepo(filepath.Join(t.TempDir(), data.MessageFileName), data.FileMessageRepoOptions{
+			Fsync: data.FsyncNever,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
+
+func TestBoltMessageRepoContract(t *testing.T) {
+	repotest.RunRepositoryContract(t, func(t *testing.T) data.MessageRepository {
+		repo, err := data.NewBoltMessageRepo(filepath.Join(t.TempDir(), data.MessageDatabaseName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
+
+func TestMemoryMessageRepoContract(t *testing.T) {
+	repotest.RunRepositoryContract(t, func(t *testing.T) data.MessageRepository {
+		return data.NewMemoryMessageRepo()
+	})
+}
@@ -0,0 +1,380 @@
+// Package repotest provides a contract test suite every message repository
+// implementation has to pass.
+package repotest
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunkit02/filete/data"
+)
+
+// Returns a new empty repository. Cleaning it up is up to the factory, e.g.
+// with t.Cleanup.
+type Factory func(t *testing.T) data.MessageRepository
+
+// Runs every contract test as a subtest, each with a fresh repository
+func RunRepositoryContract(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo data.MessageRepository)
+	}{
+		{"AssignsIds", testAssignsIds},
+		{"KeepsExplicitIds", testKeepsExplicitIds},
+		{"RejectsDuplicateIds", testRejectsDuplicateIds},
+		{"AddAllIsAtomic", testAddAllIsAtomic},
+		{"GetMissing", testGetMissing},
+		{"GetAllIsOrderedCopy", testGetAllIsOrderedCopy},
+		{"Delete", testDelete},
+		{"DeleteAll", testDeleteAll},
+		{"DoesNotReuseIds", testDoesNotReuseIds},
+		{"ConcurrentAdd", testConcurrentAdd},
+		{"Attachments", testAttachments},
+		{"Query", testQuery},
+		{"QueryPages", testQueryPages},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory(t))
+		})
+	}
+}
+
+func newMessage(body string) data.Message {
+	// Truncated so the message survives encoding unchanged
+	return data.Message{Body: body, TimeSent: time.Now().UTC().Truncate(time.Millisecond)}
+}
+
+func mustAdd(t *testing.T, repo data.MessageRepository, message data.Message) data.Message {
+	t.Helper()
+	stored, err := repo.Add(message)
+	if err != nil {
+		t.Fatalf("Failed to add %+v: %v", message, err)
+	}
+	return stored
+}
+
+func mustGetAll(t *testing.T, repo data.MessageRepository) []data.Message {
+	t.Helper()
+	messages, err := repo.GetAll()
+	if err != nil {
+		t.Fatalf("Failed to get all messages: %v", err)
+	}
+	return messages
+}
+
+func testAssignsIds(t *testing.T, repo data.MessageRepository) {
+	for i := 1; i <= 3; i++ {
+		message := newMessage("hello")
+		stored := mustAdd(t, repo, message)
+		if stored.Id != data.MessageId(i) {
+			t.Fatalf("Expected id %d. Got %d", i, stored.Id)
+		}
+
+		message.Id = stored.Id
+		if !reflect.DeepEqual(stored, message) {
+			t.Fatalf("Expected %+v to be returned. Got %+v", message, stored)
+		}
+
+		got, exists, err := repo.Get(stored.Id)
+		if err != nil || !exists || !reflect.DeepEqual(got, stored) {
+			t.Fatalf("Expected %+v. Got %+v, %v, %v", stored, got, exists, err)
+		}
+	}
+}
+
+func testKeepsExplicitIds(t *testing.T, repo data.MessageRepository) {
+	message := newMessage("imported")
+	message.Id = 42
+	if stored := mustAdd(t, repo, message); !reflect.DeepEqual(stored, message) {
+		t.Fatalf("Expected %+v. Got %+v", message, stored)
+	}
+
+	if next := mustAdd(t, repo, newMessage("next")); next.Id <= 42 {
+		t.Fatalf("Expected an id after 42. Got %d", next.Id)
+	}
+}
+
+func testRejectsDuplicateIds(t *testing.T, repo data.MessageRepository) {
+	original := mustAdd(t, repo, newMessage("original"))
+
+	duplicate := newMessage("duplicate")
+	duplicate.Id = original.Id
+	_, err := repo.Add(duplicate)
+
+	var duplicateErr *data.DuplicateEntryError[data.MessageId]
+	if !errors.As(err, &duplicateErr) {
+		t.Fatalf("Expected DuplicateEntryError. Got %v", err)
+	}
+
+	got, _, _ := repo.Get(original.Id)
+	if !reflect.DeepEqual(got, original) {
+		t.Fatalf("Expected %+v to be unchanged. Got %+v", original, got)
+	}
+}
+
+func testAddAllIsAtomic(t *testing.T, repo data.MessageRepository) {
+	taken := mustAdd(t, repo, newMessage("taken"))
+
+	fresh := newMessage("fresh")
+	fresh.Id = taken.Id + 10
+	duplicate := newMessage("duplicate")
+	duplicate.Id = taken.Id
+
+	err := repo.AddAll([]data.Message{fresh, duplicate})
+	var duplicateErr *data.DuplicateEntryError[data.MessageId]
+	if !errors.As(err, &duplicateErr) {
+		t.Fatalf("Expected DuplicateEntryError. Got %v", err)
+	}
+	if _, exists, _ := repo.Get(fresh.Id); exists {
+		t.Fatal("Expected nothing to be added when AddAll fails")
+	}
+
+	if err := repo.AddAll([]data.Message{newMessage("a"), newMessage("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if messages := mustGetAll(t, repo); len(messages) != 3 {
+		t.Fatalf("Expected 3 messages. Got %+v", messages)
+	}
+}
+
+func testGetMissing(t *testing.T, repo data.MessageRepository) {
+	message, exists, err := repo.Get(1)
+	if err != nil || exists || !reflect.DeepEqual(message, data.Message{}) {
+		t.Fatalf("Expected a missing message. Got %+v, %v, %v", message, exists, err)
+	}
+}
+
+func testGetAllIsOrderedCopy(t *testing.T, repo data.MessageRepository) {
+	for _, id := range []data.MessageId{5, 2, 9} {
+		message := newMessage("ordered")
+		message.Id = id
+		mustAdd(t, repo, message)
+	}
+
+	messages := mustGetAll(t, repo)
+	if len(messages) != 3 || messages[0].Id != 2 || messages[1].Id != 5 || messages[2].Id != 9 {
+		t.Fatalf("Expected messages ordered by id. Got %+v", messages)
+	}
+
+	messages[0].Body = "changed"
+	if got, _, _ := repo.Get(2); got.Body != "ordered" {
+		t.Fatal("Changing the result of GetAll changed the stored message")
+	}
+}
+
+func testDelete(t *testing.T, repo data.MessageRepository) {
+	first := mustAdd(t, repo, newMessage("first"))
+	second := mustAdd(t, repo, newMessage("second"))
+
+	if err := repo.Delete(first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, _ := repo.Get(first.Id); exists {
+		t.Fatal("Expected message to be deleted")
+	}
+	if messages := mustGetAll(t, repo); len(messages) != 1 || !reflect.DeepEqual(messages[0], second) {
+		t.Fatalf("Expected only %+v. Got %+v", second, messages)
+	}
+
+	// Deleting twice or something that never existed is not an error
+	if err := repo.Delete(first.Id); err != nil {
+		t.Fatalf("Expected no error deleting twice. Got %v", err)
+	}
+	if err := repo.Delete(1000); err != nil {
+		t.Fatalf("Expected no error deleting a missing message. Got %v", err)
+	}
+}
+
+func testDeleteAll(t *testing.T, repo data.MessageRepository) {
+	if err := repo.AddAll([]data.Message{newMessage("a"), newMessage("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	if messages := mustGetAll(t, repo); len(messages) != 0 {
+		t.Fatalf("Expected no messages. Got %+v", messages)
+	}
+
+	// Still usable afterwards
+	mustAdd(t, repo, newMessage("c"))
+	if messages := mustGetAll(t, repo); len(messages) != 1 {
+		t.Fatalf("Expected 1 message. Got %+v", messages)
+	}
+}
+
+func testDoesNotReuseIds(t *testing.T, repo data.MessageRepository) {
+	mustAdd(t, repo, newMessage("a"))
+	last := mustAdd(t, repo, newMessage("b"))
+
+	if err := repo.Delete(last.Id); err != nil {
+		t.Fatal(err)
+	}
+	afterDelete := mustAdd(t, repo, newMessage("c"))
+	if afterDelete.Id <= last.Id {
+		t.Fatalf("Expected an id after %d. Got %d", last.Id, afterDelete.Id)
+	}
+
+	if err := repo.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	afterDeleteAll := mustAdd(t, repo, newMessage("d"))
+	if afterDeleteAll.Id <= afterDelete.Id {
+		t.Fatalf("Expected an id after %d. Got %d", afterDelete.Id, afterDeleteAll.Id)
+	}
+}
+
+func testConcurrentAdd(t *testing.T, repo data.MessageRepository) {
+	const workers, perWorker = 8, 20
+
+	ids := make(chan data.MessageId, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				message, err := repo.Add(newMessage("concurrent"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- message.Id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[data.MessageId]bool, workers*perWorker)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("Duplicate id %d", id)
+		}
+		seen[id] = true
+	}
+	if messages := mustGetAll(t, repo); len(messages) != workers*perWorker {
+		t.Fatalf("Expected %d messages. Got %d", workers*perWorker, len(messages))
+	}
+}
+
+func testAttachments(t *testing.T, repo data.MessageRepository) {
+	message := newMessage("here's the build log")
+	message.Attachments = []data.Attachment{
+		{UploadId: "a", FileName: "build.log", Size: 1024},
+		{UploadId: "b", FileName: "test.log", Size: 0},
+	}
+	stored := mustAdd(t, repo, message)
+
+	got, _, _ := repo.Get(stored.Id)
+	if !reflect.DeepEqual(got.Attachments, message.Attachments) {
+		t.Fatalf("Expected attachments %+v. Got %+v", message.Attachments, got.Attachments)
+	}
+
+	// Neither the added nor the returned messages share memory with the
+	// stored ones
+	message.Attachments[0].FileName = "changed"
+	got.Attachments[1].FileName = "changed"
+	all := mustGetAll(t, repo)
+	all[0].Attachments[0].Size = 0
+
+	got, _, _ = repo.Get(stored.Id)
+	if got.Attachments[0].FileName != "build.log" || got.Attachments[0].Size != 1024 || got.Attachments[1].FileName != "test.log" {
+		t.Fatalf("Stored attachments were changed: %+v", got.Attachments)
+	}
+}
+
+func testQuery(t *testing.T, repo data.MessageRepository) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	messages := []data.Message{
+		{Body: "see https://example.com/a", TimeSent: start, Sender: "alice"},
+		{Body: "Meeting notes", TimeSent: start.Add(time.Hour), Sender: "bob"},
+		{Body: "the EXAMPLE notes", TimeSent: start.Add(2 * time.Hour), Sender: "Alice"},
+		{Body: "unrelated", TimeSent: start.Add(3 * time.Hour)},
+	}
+	if err := repo.AddAll(messages); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		query    data.MessageQuery
+		expected []data.MessageId
+	}{
+		{"Everything", data.MessageQuery{}, []data.MessageId{1, 2, 3, 4}},
+		{"Substring", data.MessageQuery{Text: "example.com"}, []data.MessageId{1}},
+		{"IgnoresCase", data.MessageQuery{Text: "example"}, []data.MessageId{1, 3}},
+		{"AllTokens", data.MessageQuery{Text: "notes  example"}, []data.MessageId{3}},
+		{"Sender", data.MessageQuery{Sender: "alice"}, []data.MessageId{1, 3}},
+		{"Since", data.MessageQuery{Since: start.Add(time.Hour)}, []data.MessageId{2, 3, 4}},
+		{"Until", data.MessageQuery{Until: start.Add(time.Hour)}, []data.MessageId{1}},
+		{"Range", data.MessageQuery{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []data.MessageId{2, 3}},
+		{"Combined", data.MessageQuery{Text: "notes", Sender: "bob"}, []data.MessageId{2}},
+		{"NoMatch", data.MessageQuery{Text: "missing"}, []data.MessageId{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := repo.Query(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := messageIds(got); !idsEqual(ids, test.expected) {
+				t.Fatalf("Expected %v. Got %v", test.expected, ids)
+			}
+		})
+	}
+}
+
+func testQueryPages(t *testing.T, repo data.MessageRepository) {
+	for i := 0; i < 7; i++ {
+		body := "odd"
+		if i%2 == 0 {
+			body = "even"
+		}
+		mustAdd(t, repo, newMessage(body))
+	}
+
+	query := data.MessageQuery{Text: "even", Limit: 2}
+	var pages [][]data.MessageId
+	for {
+		page, err := repo.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, messageIds(page))
+		query.AfterId = page[len(page)-1].Id
+	}
+
+	if len(pages) != 2 || !idsEqual(pages[0], []data.MessageId{1, 3}) || !idsEqual(pages[1], []data.MessageId{5, 7}) {
+		t.Fatalf("Expected pages [1 3] and [5 7]. Got %v", pages)
+	}
+}
+
+func messageIds(messages []data.Message) []data.MessageId {
+	ids := make([]data.MessageId, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+	return ids
+}
+
+func idsEqual(a, b []data.MessageId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,13 +1,34 @@
 package data
 
-import "time"
+import (
+	"slices"
+	"time"
+)
 
 type Message struct {
 	Id       MessageId `json:"id"`
 	Body     string    `json:"body"`
 	TimeSent time.Time `json:"timeSent"`
+	// Alias of the identity that sent the message, if any
+	Sender      string       `json:"sender,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
+// An upload referenced by a message
+type Attachment struct {
+	UploadId string `json:"uploadId"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+}
+
+// Returns a copy of the message that shares no memory with it
+func (message Message) clone() Message {
+	message.Attachments = slices.Clone(message.Attachments)
+	return message
+}
+
+// A registered alias. Secret is the bcrypt hash of the secret required to
+// claim the alias, never the secret itself.
 type Identity struct {
 	Secret string `json:"secret"`
 	Alias  string `json:"alias"`
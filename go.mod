@@ -2,4 +2,13 @@ module github.com/sunkit02/filete
 
 go 1.23.0
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.11
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sunkit02/filete/services"
+)
+
+// Prints the hash of the secret read from stdin, to be put into the
+// secret-hash of an identity in the config file
+func hashSecret(args []string) error {
+	flags := flag.NewFlagSet("filete hash-secret", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: filete hash-secret < secret\n\nPrints the secret-hash of an identity for the secret read from stdin.\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return errors.New("Secret must not be empty")
+	}
+
+	hash, err := services.HashSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
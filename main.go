@@ -2,9 +2,12 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"flag"
 	"io/fs"
 	"os"
 
+	"github.com/sunkit02/filete/config"
 	"github.com/sunkit02/filete/logging"
 	"github.com/sunkit02/filete/web"
 )
@@ -17,22 +20,36 @@ func init() {
 }
 
 func main() {
-	args := os.Args[1:]
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := migrate(os.Args[2:])
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			logging.Error.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-secret" {
+		err := hashSecret(os.Args[2:])
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			logging.Error.Fatal(err)
+		}
+		return
+	}
+
+	c, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		logging.Error.Fatal(err)
+	}
 
 	staticRoot, err := fs.Sub(EmbeddedAssets, "static")
 	if err != nil {
 		logging.Error.Fatal(err)
 	}
 
-	serverConfigs := web.ServerConfigs{
-		Port:      8080,
-		CertFile:  "./secrets/server.crt",
-		KeyFile:   "./secrets/server.key",
-		Assets:    staticRoot,
-		ShareDirs: args,
-		// ShareDirs:  []string{"/home/sunkit/src"},
-		UploadDir:  "./uploaded",
-		SessionKey: "123",
+	serverConfigs, err := c.ServerConfigs(staticRoot)
+	if err != nil {
+		logging.Error.Fatal(err)
 	}
 
 	web.StartServer(serverConfigs)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/sunkit02/filete/config"
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
+)
+
+// Imports the messages of a messages.dat file into a bolt database, keeping
+// their ids. Runs with the server stopped.
+func migrate(args []string) error {
+	var uploadDir, from, to string
+
+	flags := flag.NewFlagSet("filete migrate", flag.ContinueOnError)
+	flags.StringVar(&uploadDir, "upload-dir", config.DefaultUploadDir, "upload directory of the server, where both stores are by default")
+	flags.StringVar(&from, "from", "", "message file to import (default <upload-dir>/"+data.MessageFileName+")")
+	flags.StringVar(&to, "to", "", "bolt database to import into (default <upload-dir>/"+data.MessageDatabaseName+")")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: filete migrate [flags]\n\nImports messages into the bolt message store.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if from == "" {
+		from = filepath.Join(uploadDir, data.MessageFileName)
+	}
+	if to == "" {
+		to = filepath.Join(uploadDir, data.MessageDatabaseName)
+	}
+
+	// Read-only, so a missing file isn't created and the source is left as
+	// it is even if it has to be repaired
+	source, err := data.NewFileMessageRepo(from, data.FileMessageRepoOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %w", from, err)
+	}
+	defer source.Close()
+
+	destination, err := data.NewBoltMessageRepo(to)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %w", to, err)
+	}
+	defer destination.Close()
+
+	copied, skipped, err := data.MigrateMessages(source, destination)
+	if err != nil {
+		return err
+	}
+
+	logging.Info.Printf("Imported %d messages from %s into %s, skipped %d already present", copied, from, to, skipped)
+	return nil
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sunkit02/filete/logging"
+)
+
+const DefaultArchiveFormat = "zip"
+
+// ArchiveFormat describes a format directories can be downloaded in
+type ArchiveFormat struct {
+	Name        string
+	Extension   string
+	ContentType string
+
+	newWriter func(w io.Writer) (archiveWriter, error)
+}
+
+var archiveFormats = map[string]ArchiveFormat{
+	"zip": {
+		Name:        "zip",
+		Extension:   ".zip",
+		ContentType: "application/zip",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			return &zipArchiveWriter{zip: zip.NewWriter(w), method: zip.Deflate}, nil
+		},
+	},
+	"zip-store": {
+		Name:        "zip-store",
+		Extension:   ".zip",
+		ContentType: "application/zip",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			return &zipArchiveWriter{zip: zip.NewWriter(w), method: zip.Store}, nil
+		},
+	},
+	"tar": {
+		Name:        "tar",
+		Extension:   ".tar",
+		ContentType: "application/x-tar",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			return &tarArchiveWriter{tar: tar.NewWriter(w)}, nil
+		},
+	},
+	"tar.gz": {
+		Name:        "tar.gz",
+		Extension:   ".tar.gz",
+		ContentType: "application/gzip",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			compressor := gzip.NewWriter(w)
+			return &tarArchiveWriter{tar: tar.NewWriter(compressor), compressor: compressor}, nil
+		},
+	},
+	"tar.zst": {
+		Name:        "tar.zst",
+		Extension:   ".tar.zst",
+		ContentType: "application/zstd",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			compressor, err := zstd.NewWriter(w)
+			if err != nil {
+				return nil, err
+			}
+			return &tarArchiveWriter{tar: tar.NewWriter(compressor), compressor: compressor}, nil
+		},
+	},
+}
+
+var archiveFormatAliases = map[string]string{
+	"tgz":  "tar.gz",
+	"tzst": "tar.zst",
+}
+
+// Returns the archive format with the given name. An empty name returns the
+// default format.
+func ParseArchiveFormat(name string) (ArchiveFormat, error) {
+	name = strings.ToLower(name)
+	if name == "" {
+		name = DefaultArchiveFormat
+	}
+	if alias, ok := archiveFormatAliases[name]; ok {
+		name = alias
+	}
+
+	format, ok := archiveFormats[name]
+	if !ok {
+		return ArchiveFormat{}, fmt.Errorf("Unsupported archive format '%s'", name)
+	}
+	return format, nil
+}
+
+// Writes the source directory as an archive of the given format into
+// destination. Files are streamed one by one so nothing is buffered beyond the
+// current file. Symlinks are stored as links, hidden files are included and
+// special files are skipped. Returns the context's error if ctx is done before
+// the archive is complete.
+func ArchiveDirectory(ctx context.Context, format ArchiveFormat, source string, destination io.Writer) error {
+	return ArchiveFiles(ctx, format, []ArchiveSource{{
+		Path:    source,
+		Name:    filepath.Base(source),
+		rootDir: SharedRootDir{Symlinks: SymlinksList, ShowHidden: true, realPath: source},
+	}}, destination)
+}
+
+// A file or directory to add to an archive
+type ArchiveSource struct {
+	// Path of the file or directory on disk
+	Path string
+	// Name of the file or directory inside the archive
+	Name string
+
+	// Shared directory the source is part of. Its policy decides which files
+	// are added and how symlinks are handled.
+	rootDir SharedRootDir
+}
+
+// Writes all sources into one archive of the given format. Directories are
+// added recursively below their name.
+func ArchiveFiles(ctx context.Context, format ArchiveFormat, sources []ArchiveSource, destination io.Writer) error {
+	archive, err := format.newWriter(destination)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		info, err := os.Lstat(source.Path)
+		if err != nil {
+			return err
+		}
+
+		walker := archiveWalker{ctx: ctx, archive: archive, rootDir: source.rootDir, ancestors: make(map[string]bool)}
+		relPath := stripRootPath(source.Path, source.rootDir.realPath)
+		ignores := source.rootDir.ignoreMatcher(parentRelPath(relPath))
+		if err := walker.add(source.Path, relPath, source.Name, info, ignores); err != nil {
+			return err
+		}
+	}
+
+	// Writes trailing metadata, without it the archive is unreadable
+	return archive.Close()
+}
+
+// Recursively adds files to an archive following the policy and ignore
+// patterns of a shared directory
+type archiveWalker struct {
+	ctx     context.Context
+	archive archiveWriter
+	rootDir SharedRootDir
+
+	// Directories currently being added, to break symlink cycles
+	ancestors map[string]bool
+}
+
+// Adds the file at path, relPath inside the shared directory, to the archive
+// under name. ignores is the matcher of the parent directory.
+func (a archiveWalker) add(path, relPath, name string, info os.FileInfo, ignores ignoreMatcher) error {
+	if err := a.ctx.Err(); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch a.rootDir.Symlinks {
+		case SymlinksHide:
+			return nil
+		case SymlinksFollow:
+			resolved, targetInfo, err := a.rootDir.followLink(path)
+			if err != nil {
+				// Dangling or pointing outside of the shared directory
+				logging.Trace.Println("Skipping symlink", path, err)
+				return nil
+			}
+			path, info = resolved, targetInfo
+		default:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return a.archive.addSymlink(name, info, target)
+		}
+	}
+
+	if ignores.ignored(relPath, info.IsDir()) {
+		return nil
+	}
+
+	switch {
+	case info.IsDir():
+		if a.ancestors[path] {
+			logging.Trace.Println("Skipping symlink cycle at", path)
+			return nil
+		}
+		a.ancestors[path] = true
+		defer delete(a.ancestors, path)
+
+		if err := a.archive.addDir(name, info); err != nil {
+			return err
+		}
+		ignores = a.rootDir.enterDir(ignores, path, relPath)
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if a.rootDir.hides(entry.Name()) {
+				continue
+			}
+
+			entryInfo, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			err = a.add(filepath.Join(path, entry.Name()), joinRelPath(relPath, entry.Name()),
+				name+"/"+entry.Name(), entryInfo, ignores)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case info.Mode().IsRegular():
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return a.archive.addFile(name, info, contextReader{ctx: a.ctx, r: file})
+	default:
+		// Devices, sockets and pipes have no meaningful content
+		return nil
+	}
+}
+
+type archiveWriter interface {
+	addDir(name string, info os.FileInfo) error
+	addFile(name string, info os.FileInfo, content io.Reader) error
+	addSymlink(name string, info os.FileInfo, target string) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zip    *zip.Writer
+	method uint16
+}
+
+func (a *zipArchiveWriter) addDir(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+
+	_, err = a.zip.CreateHeader(header)
+	return err
+}
+
+func (a *zipArchiveWriter) addFile(name string, info os.FileInfo, content io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = a.method
+	// Compressing these again costs CPU without saving space
+	if isCompressedFile(name) {
+		header.Method = zip.Store
+	}
+
+	writer, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// Symlinks are stored the way Info-ZIP does: the mode marks the entry as a
+// link and the content is the link target.
+func (a *zipArchiveWriter) addSymlink(name string, info os.FileInfo, target string) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+
+	writer, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(writer, target)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zip.Close()
+}
+
+type tarArchiveWriter struct {
+	tar *tar.Writer
+	// Compression layer below the tar stream. nil for plain tar
+	compressor io.WriteCloser
+}
+
+func (a *tarArchiveWriter) addDir(name string, info os.FileInfo) error {
+	return a.writeHeader(name+"/", info, "")
+}
+
+func (a *tarArchiveWriter) addFile(name string, info os.FileInfo, content io.Reader) error {
+	if err := a.writeHeader(name, info, ""); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(a.tar, content)
+	return err
+}
+
+func (a *tarArchiveWriter) addSymlink(name string, info os.FileInfo, target string) error {
+	return a.writeHeader(name, info, target)
+}
+
+func (a *tarArchiveWriter) writeHeader(name string, info os.FileInfo, link string) error {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// PAX supports long names and sub-second modification times
+	header.Format = tar.FormatPAX
+
+	return a.tar.WriteHeader(header)
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tar.Close(); err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
+
+var compressedFileExtensions = map[string]bool{
+	".7z": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jpeg": true,
+	".jpg": true, ".m4a": true, ".mkv": true, ".mov": true, ".mp3": true,
+	".mp4": true, ".ogg": true, ".png": true, ".pptx": true, ".rar": true,
+	".webm": true, ".webp": true, ".xlsx": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+func isCompressedFile(name string) bool {
+	return compressedFileExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Reader failing with the context's error once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -1,8 +1,12 @@
 package services
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/sunkit02/filete/logging"
@@ -11,87 +15,420 @@ import (
 )
 
 type AuthServiceConfig struct {
-	SessionKey    string
-	SessionLength time.Duration
+	// Key clients authenticate with as RoleAdmin. A grouped base32 key, see
+	// utils.GenerateGroupedKey, is generated if empty.
+	SessionKey string
+	// Additional keys, each granting its own role
+	Keys []SessionKeyConfig
+	// Number of groups of a generated session key, DefaultSessionKeyGroups if
+	// 0. At least MinSessionKeyGroups otherwise.
+	SessionKeyGroups int
+	// Random bytes in a session id, DefaultSessionIdBytes if 0. At least
+	// MinSessionIdBytes otherwise.
+	SessionIdBytes int
+	SessionLength  time.Duration
+	// Limits on failed logins, see LoginLimits
+	Limits LoginLimits
+
+	// Where sessions are kept, memory if empty
+	SessionStore SessionStoreType
+	// File sessions are persisted in with SessionStoreFile
+	SessionFile string
+	// How often expired sessions are removed, DefaultSessionSweepInterval if 0
+	SweepInterval time.Duration
+}
+
+// A key sessions with Role are created with
+type SessionKeyConfig struct {
+	Key  string
+	Role Role
 }
 
 type UserSession struct {
-	Id      string
-	Expires time.Time
+	Id      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+	// Alias of the identity the session is bound to, see ClaimIdentity
+	Alias string `json:"alias"`
+	// Role of the key the session was created with
+	Role Role `json:"role"`
+	// Whether Alias was claimed with the secret of a configured identity, see
+	// IdentityServiceConfig.Identities
+	Verified bool `json:"verified"`
 }
 
-const DEFAULT_SESSION_LENGTH = 1 * time.Hour
+func (s UserSession) IsExpired(now time.Time) bool {
+	return s.Expires.Before(now)
+}
+
+const (
+	DEFAULT_SESSION_LENGTH      = 1 * time.Hour
+	DefaultSessionSweepInterval = 1 * time.Minute
+	// 60 bits, plenty for a key only guessable online
+	DefaultSessionKeyGroups = 3
+	// 256 bits
+	DefaultSessionIdBytes = 32
+	// 40 bits, still out of reach with the login limits
+	MinSessionKeyGroups = 2
+	// 128 bits
+	MinSessionIdBytes = 16
+)
+
+var (
+	// Guards sessionKey and sessionKeyGenerated, which change when the key
+	// is rotated
+	keyLock    sync.RWMutex
+	sessionKey string
+	// Generated keys are compared ignoring the typos NormalizeGroupedKey
+	// fixes. Keys chosen by the user are compared as they are.
+	sessionKeyGenerated bool
+	// Keys besides sessionKey, compared exactly
+	extraKeys        []SessionKeyConfig
+	sessionKeyGroups = DefaultSessionKeyGroups
+	sessionIdBytes   = DefaultSessionIdBytes
+	sessionLength    = DEFAULT_SESSION_LENGTH
+
+	limiter *loginLimiter
+)
+
+var (
+	sessions SessionStore
+	// Held while checking session keys, so parallel requests can't guess
+	// more often than the limiter allows, and while binding an alias and
+	// creating the session bound to it, so that is atomic. Not held while
+	// checking secrets.
+	loginLock    sync.Mutex
+	stopSweeping chan struct{}
+)
+
+// Can be called again, e.g. in tests, which closes the previous store
+func InitAuthService(c AuthServiceConfig) error {
+	if c.SessionKeyGroups != 0 && c.SessionKeyGroups < MinSessionKeyGroups {
+		return fmt.Errorf("Session keys need at least %d groups", MinSessionKeyGroups)
+	}
+	if c.SessionIdBytes != 0 && c.SessionIdBytes < MinSessionIdBytes {
+		return fmt.Errorf("Session ids need at least %d bytes", MinSessionIdBytes)
+	}
 
-var sessionKey string
-var sessionLength = DEFAULT_SESSION_LENGTH
+	sessionKeyGroups = DefaultSessionKeyGroups
+	if c.SessionKeyGroups != 0 {
+		sessionKeyGroups = c.SessionKeyGroups
+	}
 
-var sessions map[string]UserSession
+	seen := map[string]bool{c.SessionKey: true}
+	for _, key := range c.Keys {
+		if key.Key == "" {
+			return errors.New("Session keys must not be empty")
+		}
+		if seen[key.Key] {
+			return errors.New("Session keys must be unique")
+		}
+		seen[key.Key] = true
+		if _, err := ParseRole(string(key.Role)); err != nil {
+			return err
+		}
+	}
 
-func InitAuthService(c AuthServiceConfig) {
+	keyLock.Lock()
 	sessionKey = c.SessionKey
+	sessionKeyGenerated = false
+	extraKeys = c.Keys
+	keyLock.Unlock()
+	if c.SessionKey == "" {
+		if err := rotateSessionKey(); err != nil {
+			return err
+		}
+	}
+
+	sessionIdBytes = DefaultSessionIdBytes
+	if c.SessionIdBytes != 0 {
+		sessionIdBytes = c.SessionIdBytes
+	}
 	if c.SessionLength != 0 {
 		sessionLength = c.SessionLength
 	}
 
-	sessions = make(map[string]UserSession)
+	var store SessionStore
+	switch c.SessionStore {
+	case SessionStoreMemory, "":
+		store = NewMemorySessionStore()
+	case SessionStoreFile:
+		fileStore, err := NewFileSessionStore(c.SessionFile)
+		if err != nil {
+			return err
+		}
+		store = fileStore
+	default:
+		return fmt.Errorf("Invalid session store '%s'", c.SessionStore)
+	}
+
+	if stopSweeping != nil {
+		close(stopSweeping)
+		sessions.Close()
+	}
+	sessions = store
+
+	sweepInterval := c.SweepInterval
+	if sweepInterval == 0 {
+		sweepInterval = DefaultSessionSweepInterval
+	}
+	limiter = newLoginLimiter(c.Limits)
+	stopSweeping = make(chan struct{})
+	go sweepSessions(store, limiter, sweepInterval, stopSweeping)
+
+	return nil
+}
+
+// Removes expired sessions from store and forgets old failed logins every
+// interval until stop is closed
+func sweepSessions(store SessionStore, limiter *loginLimiter, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			limiter.prune(now)
+			removed, err := store.DeleteExpired(now)
+			if err != nil {
+				logging.Error.Printf("Failed to remove expired sessions: %v", err)
+			} else if removed > 0 {
+				logging.Debug.Printf("Removed %d expired sessions", removed)
+				publishSessionEvent(store, EventSessionEnded)
+			}
+		}
+	}
+}
+
+var ErrInvalidSessionKey = errors.New("Invalid session key")
+
+// Returns the key clients authenticate with
+func SessionKey() string {
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	return sessionKey
+}
+
+// Replaces the session key with a generated one. Existing sessions stay valid.
+func rotateSessionKey() error {
+	key, err := utils.GenerateGroupedKey(sessionKeyGroups)
+	if err != nil {
+		return fmt.Errorf("Failed to generate session key: %w", err)
+	}
+
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	sessionKey = key
+	sessionKeyGenerated = true
+	return nil
 }
 
-// Checks whether the given session key is valid and return an sessionId
-// it is and returns an error if not.
-func AuthenticateWithSessionKey(key string) (*UserSession, error) {
-	if key != sessionKey {
-		return nil, errors.New("Invalid session key")
+// Returns the role of the matching key and false if no key matches. Compares
+// against every key in constant time. Hashing first keeps the length of the
+// keys from leaking as well.
+func matchSessionKey(key string) (Role, bool) {
+	keyLock.RLock()
+	expected := sessionKey
+	generated := sessionKeyGenerated
+	keys := extraKeys
+	keyLock.RUnlock()
+
+	normalizedKey := key
+	if generated {
+		normalizedKey = utils.NormalizeGroupedKey(key)
+		expected = utils.NormalizeGroupedKey(expected)
+	}
+
+	var role Role
+	if hashesEqual(normalizedKey, expected) {
+		role = RoleAdmin
+	}
+	for _, k := range keys {
+		if hashesEqual(key, k.Key) {
+			role = k.Role
+		}
+	}
+	return role, role != ""
+}
+
+func hashesEqual(a, b string) bool {
+	aHash := sha256.Sum256([]byte(a))
+	bHash := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(aHash[:], bHash[:]) == 1
+}
+
+// Credentials sent by a client to log in
+type LoginAttempt struct {
+	// Address failed attempts are counted for
+	ClientIp   string
+	SessionKey string
+	// Identity to bind the session to, see ClaimIdentity
+	Alias  string
+	Secret string
+}
+
+// Checks whether the given session key is valid and creates a session with
+// the role of the key, bound to the identity claimed with alias and secret,
+// if it is. Returns ErrInvalidSessionKey or an error of ClaimIdentity if not,
+// and a *TooManyAttemptsError without checking anything while the client has
+// to wait after failed attempts.
+func AuthenticateWithSessionKey(attempt LoginAttempt) (*UserSession, error) {
+	role, err := checkSessionKey(attempt)
+	if err != nil {
+		return nil, err
 	}
 
-	session := createSession(sessionLength)
+	// Secrets are hashed with bcrypt, which is slow on purpose, so other
+	// logins aren't held up by it. The limiter lets every client check only
+	// one secret at a time instead.
+	claim, err := checkIdentity(attempt.Alias, attempt.Secret)
+
+	loginLock.Lock()
+	defer loginLock.Unlock()
+
+	if attempt.Secret != "" {
+		limiter.endSecretCheck(attempt.ClientIp)
+	}
+	if errors.Is(err, ErrWrongSecret) {
+		recordFailedLogin(attempt.ClientIp, false)
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	alias, err := bindIdentity(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	// Claiming a configured alias takes its secret. Generated guest aliases
+	// are never verified.
+	verified := claim.registered && isConfiguredAlias(alias)
+	session, err := createSession(sessionLength, alias, role, verified)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter.succeed(attempt.ClientIp, session.Role)
 	return session, nil
 }
 
-// Returns true if the cookie is valid and false if not
-func ValidateSessionCookie(cookie http.Cookie) bool {
+// Returns the role of the session key of attempt, recording a failure if it
+// is wrong. Also starts checking the secret of attempt, if any, see
+// loginLimiter.startSecretCheck.
+func checkSessionKey(attempt LoginAttempt) (Role, error) {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+
+	if err := limiter.check(attempt.ClientIp, time.Now()); err != nil {
+		return "", err
+	}
+
+	role, ok := matchSessionKey(attempt.SessionKey)
+	if !ok {
+		recordFailedLogin(attempt.ClientIp, true)
+		return "", ErrInvalidSessionKey
+	}
+
+	if attempt.Secret != "" && !limiter.startSecretCheck(attempt.ClientIp) {
+		return "", &TooManyAttemptsError{RetryAfter: SecretCheckRetryAfter}
+	}
+	return role, nil
+}
+
+// Must be called with loginLock held
+func recordFailedLogin(client string, wrongKey bool) {
+	if !limiter.fail(client, wrongKey, time.Now()) {
+		return
+	}
+
+	if err := rotateSessionKey(); err != nil {
+		logging.Error.Println(err)
+	} else {
+		logging.Warning.Println("Session key rotated after too many wrong keys. New session key:", SessionKey())
+	}
+}
+
+// Returns the session of the cookie and true if the cookie is valid and false
+// if not
+func ValidateSessionCookie(cookie http.Cookie) (UserSession, bool) {
 	if cookie.Name != types.SessionIdCookieName {
 		logging.Trace.Println("Invalid cookie name")
-		return false
+		return UserSession{}, false
 	}
 
-	session, ok := sessions[cookie.Value]
+	session, ok, err := sessions.Get(cookie.Value)
+	if err != nil {
+		logging.Error.Printf("Failed to read session: %v", err)
+		return UserSession{}, false
+	}
 	if !ok {
-		return false
+		return UserSession{}, false
 	}
 
-	if session.Expires.UnixMilli() < time.Now().UnixMilli() {
-		delete(sessions, cookie.Value)
-		return false
+	if session.IsExpired(time.Now()) {
+		InvalidateSession(cookie.Value)
+		return UserSession{}, false
 	}
-	return true
+	return session, true
 }
 
-func createSession(livesFor time.Duration) *UserSession {
-	sessionId := generateSessionId()
+// Must be called with loginLock held
+func createSession(livesFor time.Duration, alias string, role Role, verified bool) (*UserSession, error) {
+	var sessionId string
 	// Regenerate cookie if there is a clash
 	for {
-		if _, ok := sessions[sessionId]; ok {
-			sessionId = generateSessionId()
-		} else {
+		var err error
+		sessionId, err = utils.GenerateToken(sessionIdBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		_, exists, err := sessions.Get(sessionId)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
 			break
 		}
 	}
 
 	session := UserSession{
-		Id:      sessionId,
-		Expires: time.Now().Add(livesFor),
+		Id:       sessionId,
+		Expires:  time.Now().Add(livesFor),
+		Alias:    alias,
+		Role:     role,
+		Verified: verified,
 	}
 
-	sessions[sessionId] = session
-	return &session
+	if err := sessions.Put(session); err != nil {
+		return nil, err
+	}
+	publishSessionEvent(sessions, EventSessionCreated)
+	return &session, nil
 }
 
 // Invalidates session. If sessionId doesn't exist then it is a no-op
 func InvalidateSession(sessionId string) {
-	delete(sessions, sessionId)
+	existed, err := sessions.Delete(sessionId)
+	if err != nil {
+		logging.Error.Printf("Failed to invalidate session: %v", err)
+		return
+	}
+	if !existed {
+		return
+	}
+
+	publishSessionEvent(sessions, EventSessionEnded)
 }
 
-func generateSessionId() string {
-	return utils.GenerateRandomString(40)
+func publishSessionEvent(store SessionStore, eventType string) {
+	active, err := store.GetAll()
+	if err != nil {
+		logging.Error.Printf("Failed to count sessions: %v", err)
+		return
+	}
+	PublishEvent(Event{Type: eventType, Data: SessionEvent{ActiveSessions: len(active)}})
 }
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sunkit02/filete/web/types"
+)
+
+func TestGeneratedSessionKeyToleratesTypos(t *testing.T) {
+	initIdentityTest(t)
+	if err := InitAuthService(AuthServiceConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := SessionKey()
+	if len(key) != DefaultSessionKeyGroups*5-1 {
+		t.Fatalf("Expected %d groups of 4 characters. Got %q", DefaultSessionKeyGroups, key)
+	}
+
+	typed := strings.ToLower(strings.ReplaceAll(key, "-", " "))
+	session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: typed})
+	if err != nil {
+		t.Fatalf("Expected %q to be accepted for %q. Got %v", typed, key, err)
+	}
+	if len(session.Id) < 43 {
+		t.Fatalf("Expected a session id with at least 256 bits. Got %q", session.Id)
+	}
+}
+
+func TestSessionEntropyIsConfigurable(t *testing.T) {
+	initIdentityTest(t)
+	if err := InitAuthService(AuthServiceConfig{SessionKeyGroups: 5, SessionIdBytes: 16}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := SessionKey()
+	if len(key) != 5*5-1 {
+		t.Fatalf("Expected 5 groups of 4 characters. Got %q", key)
+	}
+	session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Id) != 22 {
+		t.Fatalf("Expected a session id with 128 bits. Got %q", session.Id)
+	}
+
+	for _, c := range []AuthServiceConfig{
+		{SessionKeyGroups: MinSessionKeyGroups - 1},
+		{SessionIdBytes: MinSessionIdBytes - 1},
+	} {
+		if err := InitAuthService(c); err == nil {
+			t.Fatalf("Expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestChosenSessionKeyIsExact(t *testing.T) {
+	if err := InitIdentityService(IdentityServiceConfig{Path: filepath.Join(t.TempDir(), "identities.json")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitAuthService(AuthServiceConfig{SessionKey: "Secret-Key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"secret-key", "SecretKey", "Secret-Key ", ""} {
+		if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: key}); !errors.Is(err, ErrInvalidSessionKey) {
+			t.Fatalf("Expected %q to be rejected. Got %v", key, err)
+		}
+	}
+	// From another address, the failures above already cause a backoff
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.2", SessionKey: "Secret-Key"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionKeysGrantRoles(t *testing.T) {
+	initIdentityTest(t)
+	err := InitAuthService(AuthServiceConfig{
+		SessionKey: "admin-key",
+		Keys: []SessionKeyConfig{
+			{Key: "drop-key", Role: RoleUploader},
+			{Key: "view-key", Role: RoleViewer},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]Role{"admin-key": RoleAdmin, "drop-key": RoleUploader, "view-key": RoleViewer} {
+		session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: key})
+		if err != nil {
+			t.Fatalf("Expected %q to be accepted. Got %v", key, err)
+		}
+		if session.Role != expected {
+			t.Fatalf("Expected role '%s' for %q. Got '%s'", expected, key, session.Role)
+		}
+		if stored, ok := ValidateSessionCookie(http.Cookie{Name: types.SessionIdCookieName, Value: session.Id}); !ok || stored.Role != expected {
+			t.Fatalf("Expected the stored session to have role '%s'. Got %+v", expected, stored)
+		}
+	}
+
+	invalid := [][]SessionKeyConfig{
+		{{Key: "", Role: RoleViewer}},
+		{{Key: "admin-key", Role: RoleViewer}},
+		{{Key: "a", Role: RoleViewer}, {Key: "a", Role: RoleUploader}},
+		{{Key: "a", Role: "root"}},
+	}
+	for _, keys := range invalid {
+		if err := InitAuthService(AuthServiceConfig{SessionKey: "admin-key", Keys: keys}); err == nil {
+			t.Fatalf("Expected %+v to be rejected", keys)
+		}
+	}
+}
+
+func TestLowerKeyLoginKeepsBackoff(t *testing.T) {
+	initIdentityTest(t)
+	err := InitAuthService(AuthServiceConfig{
+		SessionKey: "admin-key",
+		Keys:       []SessionKeyConfig{{Key: "drop-key", Role: RoleUploader}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempt := LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "guess"}
+	for i := 0; i < DefaultFreeAttempts; i++ {
+		if _, err := AuthenticateWithSessionKey(attempt); !errors.Is(err, ErrInvalidSessionKey) {
+			t.Fatalf("Expected ErrInvalidSessionKey. Got %v", err)
+		}
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "drop-key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AuthenticateWithSessionKey(attempt); !errors.Is(err, ErrInvalidSessionKey) {
+		t.Fatalf("Expected ErrInvalidSessionKey. Got %v", err)
+	}
+	if _, err := AuthenticateWithSessionKey(attempt); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected to back off after the uploader login. Got %v", err)
+	}
+}
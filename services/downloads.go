@@ -1,12 +1,11 @@
 package services
 
 import (
-	"archive/zip"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/sunkit02/filete/logging"
-	"github.com/sunkit02/filete/utils"
 	"io"
 	"os"
 	"path/filepath"
@@ -24,6 +23,20 @@ var sharedRootDirs map[string]SharedRootDir
 type SharedRootDir struct {
 	Id   string
 	Path string
+
+	Symlinks    SymlinkPolicy
+	ShowHidden  bool
+	IgnoreFiles bool
+	// Who may list and download from the directory, see allows
+	AllowedRoles   []Role
+	AllowedAliases []string
+
+	// Global exclude patterns, see DownloadServiceConfig.Excludes
+	excludes []ignoreRule
+
+	// Absolute path of the directory with symlinks resolved. Every shared file
+	// has to be inside of it.
+	realPath string
 }
 
 type SharedFile struct {
@@ -32,31 +45,83 @@ type SharedFile struct {
 	Path        string `json:"path"`
 	Size        int64  `json:"size"`
 	RootDirHash string `json:"rootDirHash"`
+	// Set for symlinks that are listed but not followed
+	IsSymlink bool `json:"isSymlink"`
 
 	// This is not nil only if FType == Directory, but it still can be nil even
 	// if FType == Directory when the contents has yet to be fetched
 	Children []SharedFile `json:"children"`
 }
 
+type SharedDirectoryConfig struct {
+	Path string
+	// Defaults to DefaultSymlinkPolicy if empty
+	Symlinks SymlinkPolicy
+	// Whether dotfiles are listed and can be downloaded
+	ShowHidden bool
+	// Whether .gitignore and .fileteignore files inside the directory are
+	// honored, see IgnoreFileNames
+	IgnoreFiles bool
+	// Roles and registered aliases of identities allowed to list and download
+	// from the directory besides admins. Everyone is allowed if both are empty.
+	AllowedRoles   []Role
+	AllowedAliases []string
+}
+
 type DownloadServiceConfig struct {
-	SharedDirectories []string
+	SharedDirectories []SharedDirectoryConfig
+	// .gitignore style patterns excluding files from every shared directory
+	Excludes []string
 }
 
-func InitDownloadService(c DownloadServiceConfig) {
+func InitDownloadService(c DownloadServiceConfig) error {
+	excludes := parseIgnorePatterns(c.Excludes, "")
+
 	sharedRootDirs = make(map[string]SharedRootDir)
-	for _, path := range c.SharedDirectories {
-		id := hashSHA256(path)
+	for _, dir := range c.SharedDirectories {
+		realPath, err := realRootPath(dir.Path)
+		if err != nil {
+			return fmt.Errorf("Invalid shared directory %s: %w", dir.Path, err)
+		}
+
+		symlinks, err := ParseSymlinkPolicy(string(dir.Symlinks))
+		if err != nil {
+			return err
+		}
+		for _, role := range dir.AllowedRoles {
+			if _, err := ParseRole(string(role)); err != nil {
+				return fmt.Errorf("Shared directory %s: %w", dir.Path, err)
+			}
+		}
+
+		id := hashSHA256(dir.Path)
 		sharedRootDirs[id] = SharedRootDir{
-			Id:   id,
-			Path: path,
+			Id:             id,
+			Path:           dir.Path,
+			Symlinks:       symlinks,
+			ShowHidden:     dir.ShowHidden,
+			IgnoreFiles:    dir.IgnoreFiles,
+			AllowedRoles:   dir.AllowedRoles,
+			AllowedAliases: dir.AllowedAliases,
+			excludes:       excludes,
+			realPath:       realPath,
 		}
 	}
+
+	return nil
 }
 
-func ReadRootDirs(depth int) ([]SharedFile, error) {
+var ErrShareAccessDenied = errors.New("Not allowed to access this shared directory")
+
+// Returns the shared root directories session may access
+func ReadRootDirs(session UserSession, depth int) ([]SharedFile, error) {
 	sharedDirs := make([]SharedFile, 0, len(sharedRootDirs))
-	for hash := range sharedRootDirs {
-		dir, err := ReadDir("", hash, depth)
+	for hash, rootDir := range sharedRootDirs {
+		if !rootDir.allows(session) {
+			continue
+		}
+
+		dir, err := ReadDir(session, "", hash, depth)
 		if err != nil {
 			return nil, err
 		}
@@ -67,67 +132,161 @@ func ReadRootDirs(depth int) ([]SharedFile, error) {
 	return sharedDirs, nil
 }
 
-func ReadDir(path, rootDirHash string, depth int) (SharedFile, error) {
+func ReadDir(session UserSession, path, rootDirHash string, depth int) (SharedFile, error) {
 	logging.Debug.Println("ReadDir Path: "+path, "Root hash: "+rootDirHash, "depth:", depth)
-	rootDir, ok := sharedRootDirs[rootDirHash]
-	if !ok {
-		return SharedFile{}, errors.New("Invalid rootDirHash")
+	rootDir, err := accessRootDir(session, rootDirHash)
+	if err != nil {
+		return SharedFile{}, err
 	}
-	divider := "/"
-	// To avoid double '/' when path is empty (reading a Root Directory)
-	if path == "" {
-		divider = ""
+
+	fullPath, err := rootDir.resolve(path)
+	if err != nil {
+		return SharedFile{}, err
 	}
-	path = rootDir.Path + divider + path
 
-	return readDir(path, rootDirHash, depth)
+	return readDir(fullPath, rootDirHash, depth)
 }
 
-// Returns the bytes of a file, file name, and an error if there is any.
-// If the file is a directory it will be returned in the form of a zip file.
-func GetFileForDownload(path, rootDirHash string) (io.Reader, string, bool, error) {
-	logging.Debug.Printf("GetFileBytes(%v, %v)", path, rootDirHash)
+var ErrIsDirectory = errors.New("Is a directory")
 
-	rootDir, ok := sharedRootDirs[rootDirHash]
-	if !ok {
-		return nil, "", false, errors.New("Invalid rootDirHash")
+// Returns the info of a shared file or directory
+func GetFileInfo(session UserSession, path, rootDirHash string) (os.FileInfo, error) {
+	_, info, err := statSharedFile(session, path, rootDirHash)
+	return info, err
+}
+
+// Opens a shared regular file for download and returns it along with its
+// info. Returns ErrIsDirectory for directories, which have to be streamed with
+// WriteDirectoryArchive instead.
+func GetFileForDownload(session UserSession, path, rootDirHash string) (*os.File, os.FileInfo, error) {
+	logging.Debug.Printf("GetFileForDownload(%v, %v)", path, rootDirHash)
+
+	fullPath, info, err := statSharedFile(session, path, rootDirHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, ErrIsDirectory
 	}
 
-	fullPath := rootDir.Path
-	// Only add '/' separator when path is not empty.
-	// Unnecessary currently but for good measure.
-	if path != "" {
-		fullPath += "/" + path
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	info, err := os.Stat(fullPath)
+	return file, info, nil
+}
+
+// Streams a shared directory as an archive of the given format into w while
+// walking it. Stops and returns the context's error as soon as ctx is done.
+func WriteDirectoryArchive(ctx context.Context, w io.Writer, format ArchiveFormat, session UserSession, path, rootDirHash string) error {
+	logging.Debug.Printf("WriteDirectoryArchive(%v, %v, %v)", format.Name, path, rootDirHash)
+
+	fullPath, info, err := statSharedFile(session, path, rootDirHash)
 	if err != nil {
-		return nil, "", false, err
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(path + " is not a directory")
 	}
 
-	if info.IsDir() {
-		tmpFilePath := "/tmp/filete-downloads-" + utils.GenerateRandomString(10) + ".zip"
-		zipFile, err := os.Create(tmpFilePath)
-		if err != nil {
-			return nil, "", false, err
-		}
-		ZipDirectory(fullPath, zipFile)
-		zipFile.Close()
+	return ArchiveFiles(ctx, format, []ArchiveSource{
+		{Path: fullPath, Name: info.Name(), rootDir: sharedRootDirs[rootDirHash]},
+	}, w)
+}
 
-		zipFile, err = os.Open(tmpFilePath)
-		if err != nil {
-			return nil, "", false, err
-		}
+// Maximum number of items that can be downloaded in a single batch
+const MaxBatchDownloadItems = 1000
+
+var ErrBadBatchRequest = errors.New("Invalid batch download")
+
+// A shared file or directory to include in a batch download
+type BatchDownloadItem struct {
+	RootDirHash string `json:"rootDirHash"`
+	Path        string `json:"path"`
+}
 
-		return zipFile, info.Name(), true, nil
-	} else {
-		file, err := os.Open(fullPath)
+// Resolves all items of a batch download into archive sources. Every item is
+// placed at the top level of the archive under its own name, with a numeric
+// suffix added when names clash (e.g. items from different shared roots).
+// Returns an error before anything is written if any of the items is invalid.
+func ResolveBatchDownload(session UserSession, items []BatchDownloadItem) ([]ArchiveSource, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: no items to download", ErrBadBatchRequest)
+	}
+	if len(items) > MaxBatchDownloadItems {
+		return nil, fmt.Errorf("%w: more than %d items", ErrBadBatchRequest, MaxBatchDownloadItems)
+	}
+
+	sources := make([]ArchiveSource, 0, len(items))
+	usedNames := make(map[string]bool, len(items))
+	for _, item := range items {
+		fullPath, info, err := statSharedFile(session, item.Path, item.RootDirHash)
 		if err != nil {
-			return nil, "", false, err
+			return nil, err
 		}
 
-		return file, info.Name(), false, nil
+		sources = append(sources, ArchiveSource{
+			Path:    fullPath,
+			Name:    uniqueName(info.Name(), usedNames),
+			rootDir: sharedRootDirs[item.RootDirHash],
+		})
+	}
+
+	return sources, nil
+}
+
+// Streams the sources of a batch download as one archive into w
+func WriteBatchArchive(ctx context.Context, w io.Writer, format ArchiveFormat, sources []ArchiveSource) error {
+	logging.Debug.Printf("WriteBatchArchive(%v, %d sources)", format.Name, len(sources))
+	return ArchiveFiles(ctx, format, sources, w)
+}
+
+// Returns name, or name with a " (n)" suffix before its extension if it is
+// already used, and marks the result as used.
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	ext := filepath.Ext(name)
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+
+	used[unique] = true
+	return unique
+}
+
+// Returns the canonical full path and info of a file inside a shared root
+// directory. See SharedRootDir.resolve for how path is validated.
+func statSharedFile(session UserSession, path, rootDirHash string) (string, os.FileInfo, error) {
+	rootDir, err := accessRootDir(session, rootDirHash)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fullPath, err := rootDir.resolve(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return fullPath, info, nil
+}
+
+// Returns the shared root directory with the given hash if session may access
+// it
+func accessRootDir(session UserSession, rootDirHash string) (SharedRootDir, error) {
+	rootDir, ok := sharedRootDirs[rootDirHash]
+	if !ok {
+		return SharedRootDir{}, ErrInvalidRootDir
 	}
+	if !rootDir.allows(session) {
+		return SharedRootDir{}, ErrShareAccessDenied
+	}
+	return rootDir, nil
 }
 
 func readDir(path, rootDirHash string, depth int) (SharedFile, error) {
@@ -136,9 +295,13 @@ func readDir(path, rootDirHash string, depth int) (SharedFile, error) {
 		return SharedFile{}, fmt.Errorf("Depth must be >= 1. Got %d", depth)
 	}
 
-	rootDirPath := sharedRootDirs[rootDirHash].Path
+	rootDir := sharedRootDirs[rootDirHash]
+	rootDirPath := rootDir.realPath
 
 	stat, err := os.Stat(path)
+	if err != nil {
+		return SharedFile{}, err
+	}
 	if !stat.IsDir() {
 		return SharedFile{}, errors.New(path + " is not a directory")
 	}
@@ -149,10 +312,17 @@ func readDir(path, rootDirHash string, depth int) (SharedFile, error) {
 		return SharedFile{}, err
 	}
 
+	relPath := stripRootPath(path, rootDirPath)
+	ignores := rootDir.ignoreMatcher(relPath)
+
 	children := make([]SharedFile, 0)
 	for _, entry := range dirEntries {
 		logging.Trace.Println("Found entry ", entry.Name(), " isDir:", entry.IsDir())
 
+		if rootDir.hides(entry.Name()) {
+			continue
+		}
+
 		info, err := entry.Info()
 		if err != nil {
 			logging.Debug.Println("Failed to get entry info for", entry.Name(), err)
@@ -162,6 +332,29 @@ func readDir(path, rootDirHash string, depth int) (SharedFile, error) {
 		// set file type to `File` initially
 		childName := info.Name()
 		childPath := path + "/" + childName
+		isSymlink := false
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch rootDir.Symlinks {
+			case SymlinksHide:
+				continue
+			case SymlinksList:
+				isSymlink = true
+			case SymlinksFollow:
+				_, targetInfo, err := rootDir.followLink(childPath)
+				if err != nil {
+					// Dangling or pointing outside of the shared directory
+					logging.Trace.Println("Skipping symlink", childPath, err)
+					continue
+				}
+				info = targetInfo
+			}
+		}
+
+		if ignores.ignored(joinRelPath(relPath, childName), info.IsDir()) {
+			continue
+		}
+
 		childSize := info.Size()
 		var childChildren []SharedFile
 
@@ -182,6 +375,7 @@ func readDir(path, rootDirHash string, depth int) (SharedFile, error) {
 				Path:        stripRootPath(childPath, rootDirPath),
 				Size:        childSize,
 				RootDirHash: rootDirHash,
+				IsSymlink:   isSymlink,
 				Children:    childChildren,
 			})
 		}
@@ -214,70 +408,17 @@ func hashSHA256(s string) string {
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
-// Strips the given root path from a path and returns the new relative path.
-// Does nothing if the root path is not part of the path.
+// Strips the given root path from a path and returns the new relative path
+// separated by '/'. Does nothing if the path is not inside the root path.
 func stripRootPath(path string, rootPath string) string {
-	if !strings.HasPrefix(path, rootPath) {
+	if !isWithin(rootPath, path) {
 		return path
 	}
 
-	path = strings.Split(path, rootPath)[1]
-	// Strip leading '/' after stripping root path
-	if strings.HasPrefix(path, "/") {
-		path = strings.SplitN(path, "/", 2)[1]
+	relPath, err := filepath.Rel(rootPath, path)
+	if err != nil || relPath == "." {
+		return ""
 	}
 
-	return path
-}
-
-// TODO: Understand how zip and compression works at a deeper level
-func ZipDirectory(source string, destination io.Writer) error {
-	// Create a new zip writer
-	zipWriter := zip.NewWriter(destination)
-	defer zipWriter.Close()
-
-	// Walk through the source directory
-	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Create the zip file header
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		// Set the correct path in the zip archive (relative to the source directory)
-		header.Name = strings.TrimPrefix(path, filepath.Dir(source)+"/")
-
-		// If it's a directory, we need to mark it as a directory in the header
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
-			header.Method = zip.Deflate // Use Deflate compression method for files
-		}
-
-		// Create the writer in the zip archive
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		// If it's a file, copy the file data to the zip archive
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-
-			_, err = io.Copy(writer, file)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
-	})
+	return filepath.ToSlash(relPath)
 }
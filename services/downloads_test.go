@@ -1,24 +1,45 @@
 package services
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
 )
 
 var DownloadServiceConfigs DownloadServiceConfig
 
+// Allowed to access every shared directory
+var adminSession = UserSession{Role: RoleAdmin}
+
+func init() {
+	logging.InitializeLoggers(os.Stdout)
+}
+
 func initializeService() string {
-	tmpDirPath, err := os.MkdirTemp("", "github.com/sunkit02/filete_downloads_test-*")
+	tmpDirPath, err := os.MkdirTemp("", "filete_downloads_test-*")
 	if err != nil {
 		panic(err)
 	}
 
-	DownloadServiceConfigs = DownloadServiceConfig{SharedDirectories: []string{tmpDirPath}}
+	DownloadServiceConfigs = DownloadServiceConfig{
+		SharedDirectories: []SharedDirectoryConfig{{Path: tmpDirPath}},
+	}
 
-	InitDownloadService(DownloadServiceConfigs)
+	err = InitDownloadService(DownloadServiceConfigs)
+	if err != nil {
+		panic(err)
+	}
 
 	return tmpDirPath
 }
@@ -67,3 +88,193 @@ func TestReadDir(t *testing.T) {
 		t.Fatalf("Expected:\n%+v.\nGot:\n%+v", expectedChildren, dir.Children)
 	}
 }
+
+func TestArchiveDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(tmpDir+"/foo", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpDir+"/foo/bar.txt", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	format, err := ParseArchiveFormat("zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := ArchiveDirectory(context.Background(), format, tmpDir+"/foo", &buffer); err != nil {
+		t.Fatalf("Failed to zip directory: %v", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+
+	names := make([]string, 0, len(reader.File))
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	expectedNames := []string{"foo/", "foo/bar.txt"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("Expected %v. Got %v", expectedNames, names)
+	}
+}
+
+func TestArchiveDirectoryCanceled(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	format, err := ParseArchiveFormat("tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ArchiveDirectory(ctx, format, tmpDir, io.Discard)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected %v. Got %v", context.Canceled, err)
+	}
+}
+
+func TestResolveBatchDownload(t *testing.T) {
+	tmpDir := initializeService()
+	defer os.RemoveAll(tmpDir)
+
+	for _, dir := range []string{"a", "b"} {
+		if err := os.MkdirAll(tmpDir+"/"+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(tmpDir+"/"+dir+"/notes.txt", []byte(dir), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootDirHash := hashSHA256(tmpDir)
+	sources, err := ResolveBatchDownload(adminSession, []BatchDownloadItem{
+		{RootDirHash: rootDirHash, Path: "a/notes.txt"},
+		{RootDirHash: rootDirHash, Path: "b/notes.txt"},
+		{RootDirHash: rootDirHash, Path: "b"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve batch download: %v", err)
+	}
+
+	expected := []ArchiveSource{
+		{Path: tmpDir + "/a/notes.txt", Name: "notes.txt"},
+		{Path: tmpDir + "/b/notes.txt", Name: "notes (2).txt"},
+		{Path: tmpDir + "/b", Name: "b"},
+	}
+	if len(sources) != len(expected) {
+		t.Fatalf("Expected %d sources. Got %d", len(expected), len(sources))
+	}
+	for i := range expected {
+		if sources[i].Path != expected[i].Path || sources[i].Name != expected[i].Name {
+			t.Fatalf("Expected:\n%+v\nGot:\n%+v", expected[i], sources[i])
+		}
+	}
+
+	_, err = ResolveBatchDownload(adminSession, []BatchDownloadItem{{RootDirHash: "invalid", Path: "a"}})
+	if err == nil {
+		t.Fatal("Expected an error for an invalid rootDirHash")
+	}
+}
+
+func TestShareAccess(t *testing.T) {
+	hash, err := HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InitIdentityService(IdentityServiceConfig{
+		Path:       filepath.Join(t.TempDir(), data.IdentityFileName),
+		Identities: []data.Identity{{Alias: "alice", Secret: hash}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InitAuthService(AuthServiceConfig{
+		SessionKey: "admin-key",
+		Keys:       []SessionKeyConfig{{Key: "view-key", Role: RoleViewer}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "view-key", Alias: "alice", Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.2", SessionKey: "view-key", Alias: "alice", Secret: "guess"}); !errors.Is(err, ErrWrongSecret) {
+		t.Fatalf("Expected ErrWrongSecret. Got %v", err)
+	}
+	// bob is allowed but not configured, so a guest can register it
+	guestBob, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.3", SessionKey: "view-key", Alias: "bob", Secret: "mine now"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, private := t.TempDir(), t.TempDir()
+	for _, dir := range []string{public, private} {
+		if err := os.WriteFile(dir+"/file.txt", []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = InitDownloadService(DownloadServiceConfig{
+		SharedDirectories: []SharedDirectoryConfig{
+			{Path: public},
+			{Path: private, AllowedRoles: []Role{RoleContributor}, AllowedAliases: []string{"Alice", "bob"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateHash := hashSHA256(private)
+
+	tests := []struct {
+		session UserSession
+		allowed bool
+	}{
+		{adminSession, true},
+		{UserSession{Role: RoleContributor}, true},
+		{*alice, true},
+		{UserSession{Role: RoleViewer}, false},
+		// Claimed before alice was configured
+		{UserSession{Role: RoleViewer, Alias: "alice"}, false},
+		{*guestBob, false},
+	}
+
+	for _, test := range tests {
+		roots, err := ReadRootDirs(test.session, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedRoots := 1
+		if test.allowed {
+			expectedRoots = 2
+		}
+		if len(roots) != expectedRoots {
+			t.Fatalf("Expected %d shared directories for %+v. Got %+v", expectedRoots, test.session, roots)
+		}
+
+		file, _, err := GetFileForDownload(test.session, "file.txt", privateHash)
+		if test.allowed {
+			if err != nil {
+				t.Fatalf("Expected %+v to be allowed. Got %v", test.session, err)
+			}
+			file.Close()
+		} else if !errors.Is(err, ErrShareAccessDenied) {
+			t.Fatalf("Expected %+v to be denied. Got %v", test.session, err)
+		}
+	}
+
+	_, err = ResolveBatchDownload(UserSession{Role: RoleViewer}, []BatchDownloadItem{
+		{RootDirHash: hashSHA256(public), Path: "file.txt"},
+		{RootDirHash: privateHash, Path: "file.txt"},
+	})
+	if !errors.Is(err, ErrShareAccessDenied) {
+		t.Fatalf("Expected the batch download to be denied. Got %v", err)
+	}
+}
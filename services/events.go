@@ -0,0 +1,88 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/sunkit02/filete/logging"
+)
+
+// Types of the events published to subscribers
+const (
+	EventMessageCreated  = "message-created"
+	EventUploadCompleted = "upload-completed"
+	EventSessionCreated  = "session-created"
+	EventSessionEnded    = "session-ended"
+)
+
+// Number of events buffered for every subscriber. Subscribers falling further
+// behind are dropped and have to subscribe again.
+const EventBufferSize = 64
+
+type Event struct {
+	// Set for events that can be replayed, e.g. the id of a created message
+	Id   string
+	Type string
+	Data any
+	// Only delivered to subscribers of the session with this id if set, e.g.
+	// for progress events naming files other sessions may not access
+	SessionId string
+}
+
+// Sent to everyone, so it must not carry the upload id, which is needed to
+// attach or manage the upload
+type UploadCompletedEvent struct {
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+}
+
+type SessionEvent struct {
+	ActiveSessions int `json:"activeSessions"`
+}
+
+var (
+	subscribersLock sync.Mutex
+	// Maps every subscriber to the id of its session
+	subscribers = make(map[chan Event]string)
+)
+
+// Returns a channel receiving every event for session published from now on
+// and a function to unsubscribe. The channel is closed when unsubscribing or
+// when the subscriber doesn't keep up with the published events.
+func SubscribeEvents(session UserSession) (<-chan Event, func()) {
+	events := make(chan Event, EventBufferSize)
+
+	subscribersLock.Lock()
+	subscribers[events] = session.Id
+	subscribersLock.Unlock()
+
+	unsubscribe := func() {
+		subscribersLock.Lock()
+		defer subscribersLock.Unlock()
+		if _, ok := subscribers[events]; ok {
+			delete(subscribers, events)
+			close(events)
+		}
+	}
+
+	return events, unsubscribe
+}
+
+// Sends an event to all subscribers it is meant for without blocking
+func PublishEvent(event Event) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	for events, sessionId := range subscribers {
+		if event.SessionId != "" && event.SessionId != sessionId {
+			continue
+		}
+
+		select {
+		case events <- event:
+		default:
+			logging.Warning.Println("Dropping event subscriber that fell behind")
+			delete(subscribers, events)
+			close(events)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package services
+
+import "testing"
+
+func TestPublishEvent(t *testing.T) {
+	events, unsubscribe := SubscribeEvents(UserSession{})
+	defer unsubscribe()
+
+	PublishEvent(Event{Id: "1", Type: EventMessageCreated, Data: "hello"})
+
+	event := <-events
+	if event.Id != "1" || event.Type != EventMessageCreated || event.Data != "hello" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	slow, unsubscribeSlow := SubscribeEvents(UserSession{})
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := SubscribeEvents(UserSession{})
+	defer unsubscribeFast()
+
+	for i := 0; i <= EventBufferSize; i++ {
+		PublishEvent(Event{Type: EventUploadCompleted})
+		<-fast
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != EventBufferSize {
+		t.Fatalf("Expected %d buffered events before closing. Got %d", EventBufferSize, received)
+	}
+
+	PublishEvent(Event{Type: EventUploadCompleted})
+	if _, ok := <-fast; !ok {
+		t.Fatal("Subscriber keeping up was dropped")
+	}
+}
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	events, unsubscribe := SubscribeEvents(UserSession{})
+	unsubscribe()
+	unsubscribe()
+
+	if _, ok := <-events; ok {
+		t.Fatal("Expected channel to be closed")
+	}
+	PublishEvent(Event{Type: EventSessionEnded})
+}
+
+func TestSessionEventsOnlyReachTheirSession(t *testing.T) {
+	own, unsubscribeOwn := SubscribeEvents(UserSession{Id: "own"})
+	defer unsubscribeOwn()
+	other, unsubscribeOther := SubscribeEvents(UserSession{Id: "other"})
+	defer unsubscribeOther()
+
+	NewDownloadProgress(UserSession{Id: "own"}, "1", "private.txt", 10).Finish()
+	PublishEvent(Event{Type: EventSessionCreated})
+
+	if event := <-own; event.Type != EventDownloadProgress {
+		t.Fatalf("Expected the progress event. Got %+v", event)
+	}
+	if event := <-other; event.Type != EventSessionCreated {
+		t.Fatalf("Expected only the event for everyone. Got %+v", event)
+	}
+}
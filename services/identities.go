@@ -0,0 +1,267 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MaxAliasLength = 32
+	// Longest secret bcrypt can hash, in bytes
+	MaxSecretLength = 72
+	// Prefix of the aliases generated for sessions that didn't choose one
+	GuestAliasPrefix = "guest-"
+
+	guestAliasAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+)
+
+var (
+	ErrInvalidAlias  = errors.New("Alias must be 1 to 32 printable characters")
+	ErrAliasTaken    = errors.New("Alias is already in use")
+	ErrWrongSecret   = errors.New("Wrong secret for alias")
+	ErrInvalidSecret = errors.New("Secret must be at most 72 bytes")
+)
+
+var (
+	identityRepo *data.IdentityRepo
+	// Identities from IdentityServiceConfig.Identities by lowercased alias
+	configuredIdentities map[string]data.Identity
+)
+
+type IdentityServiceConfig struct {
+	// File registered identities are persisted in
+	Path string
+	// Identities set up by the admin, e.g. in the config file, with Secret
+	// holding a bcrypt hash, see HashSecret. They take precedence over
+	// registered identities and, unlike those, can be granted access to
+	// shares as nobody else can claim them first.
+	Identities []data.Identity
+}
+
+func InitIdentityService(c IdentityServiceConfig) error {
+	configured := make(map[string]data.Identity, len(c.Identities))
+	for _, identity := range c.Identities {
+		if err := ValidateIdentity(identity); err != nil {
+			return err
+		}
+		key := strings.ToLower(identity.Alias)
+		if _, ok := configured[key]; ok {
+			return fmt.Errorf("Identity '%s' is defined twice", identity.Alias)
+		}
+		configured[key] = identity
+	}
+
+	repo, err := data.NewIdentityRepo(c.Path)
+	if err != nil {
+		return err
+	}
+
+	identityRepo = repo
+	configuredIdentities = configured
+	return nil
+}
+
+// Checks an identity set up by the admin, see IdentityServiceConfig.Identities
+func ValidateIdentity(identity data.Identity) error {
+	if identity.Alias == "" || !isValidAlias(identity.Alias) {
+		return fmt.Errorf("Identity '%s': %w", identity.Alias, ErrInvalidAlias)
+	}
+	if _, err := bcrypt.Cost([]byte(identity.Secret)); err != nil {
+		return fmt.Errorf("Identity '%s': secret must be a bcrypt hash: %w", identity.Alias, err)
+	}
+	return nil
+}
+
+// Returns the bcrypt hash identities are stored with
+func HashSecret(secret string) (string, error) {
+	if len(secret) > MaxSecretLength {
+		return "", ErrInvalidSecret
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Returns the alias a new session is bound to.
+//
+// A registered alias can only be claimed with its secret, from any number of
+// sessions. An unregistered alias is registered if a secret is given, so it
+// can be reclaimed later, and is otherwise only bound to the session as long
+// as it lasts. An empty alias gets a generated guest alias.
+func ClaimIdentity(alias string, secret string) (string, error) {
+	claim, err := checkIdentity(alias, secret)
+	if err != nil {
+		return "", err
+	}
+	return bindIdentity(claim)
+}
+
+// An alias checked by checkIdentity, to be bound to a session with
+// bindIdentity
+type identityClaim struct {
+	// Empty for a generated guest alias
+	alias string
+	// Whether the alias is registered and the secret matched
+	registered bool
+	// Hash to register an unregistered alias with, empty to not register it
+	secretHash string
+}
+
+// The slow part of ClaimIdentity, checking or hashing the secret. Doesn't
+// need loginLock, unlike bindIdentity.
+func checkIdentity(alias string, secret string) (identityClaim, error) {
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return identityClaim{}, nil
+	}
+	if !isValidAlias(alias) {
+		return identityClaim{}, ErrInvalidAlias
+	}
+	if len(secret) > MaxSecretLength {
+		return identityClaim{}, ErrInvalidSecret
+	}
+
+	identity, registered, err := getIdentity(alias)
+	if err != nil {
+		return identityClaim{}, err
+	}
+	if registered {
+		if secret == "" {
+			return identityClaim{}, ErrAliasTaken
+		}
+		if bcrypt.CompareHashAndPassword([]byte(identity.Secret), []byte(secret)) != nil {
+			return identityClaim{}, ErrWrongSecret
+		}
+		return identityClaim{alias: identity.Alias, registered: true}, nil
+	}
+
+	// Checked again by bindIdentity, this only saves hashing for nothing
+	inUse, err := isAliasInUse(alias)
+	if err != nil {
+		return identityClaim{}, err
+	}
+	if inUse {
+		return identityClaim{}, ErrAliasTaken
+	}
+	if secret == "" {
+		return identityClaim{alias: alias}, nil
+	}
+
+	hash, err := HashSecret(secret)
+	if err != nil {
+		return identityClaim{}, err
+	}
+	return identityClaim{alias: alias, secretHash: hash}, nil
+}
+
+// Returns the alias of a checked claim, registering it if requested. Must be
+// called with loginLock held so the alias can't be taken before the session
+// bound to it is created.
+func bindIdentity(claim identityClaim) (string, error) {
+	if claim.alias == "" {
+		return generateGuestAlias()
+	}
+	if claim.registered {
+		return claim.alias, nil
+	}
+
+	// Someone may have registered or bound the alias while it was checked
+	_, registered, err := getIdentity(claim.alias)
+	if err != nil {
+		return "", err
+	}
+	inUse, err := isAliasInUse(claim.alias)
+	if err != nil {
+		return "", err
+	}
+	if registered || inUse {
+		return "", ErrAliasTaken
+	}
+	if claim.secretHash == "" {
+		return claim.alias, nil
+	}
+
+	_, err = identityRepo.Add(data.Identity{Alias: claim.alias, Secret: claim.secretHash})
+	var duplicate *data.DuplicateEntryError[string]
+	if errors.As(err, &duplicate) {
+		return "", ErrAliasTaken
+	} else if err != nil {
+		return "", err
+	}
+
+	return claim.alias, nil
+}
+
+// Returns the configured or registered identity of alias
+func getIdentity(alias string) (data.Identity, bool, error) {
+	if identity, ok := configuredIdentities[strings.ToLower(alias)]; ok {
+		return identity, true, nil
+	}
+	return identityRepo.Get(alias)
+}
+
+// Reports whether alias belongs to one of IdentityServiceConfig.Identities
+func isConfiguredAlias(alias string) bool {
+	_, ok := configuredIdentities[strings.ToLower(alias)]
+	return ok
+}
+
+func isValidAlias(alias string) bool {
+	if utf8.RuneCountInString(alias) > MaxAliasLength {
+		return false
+	}
+	for _, r := range alias {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether an active session is bound to the alias, ignoring case
+func isAliasInUse(alias string) (bool, error) {
+	active, err := sessions.GetAll()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for _, session := range active {
+		if !session.IsExpired(now) && strings.EqualFold(session.Alias, alias) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func generateGuestAlias() (string, error) {
+	for {
+		suffix, err := utils.GenerateRandomString(guestAliasAlphabet, 6)
+		if err != nil {
+			return "", err
+		}
+		alias := GuestAliasPrefix + suffix
+		_, registered, err := identityRepo.Get(alias)
+		if err != nil {
+			return "", err
+		}
+		if registered {
+			continue
+		}
+		inUse, err := isAliasInUse(alias)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return alias, nil
+		}
+	}
+}
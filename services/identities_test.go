@@ -0,0 +1,119 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sunkit02/filete/data"
+)
+
+func initIdentityTest(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), data.IdentityFileName)
+	if err := InitIdentityService(IdentityServiceConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitAuthService(AuthServiceConfig{SessionKey: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticateBindsAlias(t *testing.T) {
+	initIdentityTest(t)
+
+	session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: " alice "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Alias != "alice" {
+		t.Fatalf("Expected alias 'alice'. Got '%s'", session.Alias)
+	}
+
+	guest, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(guest.Alias, GuestAliasPrefix) {
+		t.Fatalf("Expected a guest alias. Got '%s'", guest.Alias)
+	}
+
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "wrong", Alias: "bob"}); !errors.Is(err, ErrInvalidSessionKey) {
+		t.Fatalf("Expected ErrInvalidSessionKey. Got %v", err)
+	}
+}
+
+func TestAliasInUseCannotBeClaimed(t *testing.T) {
+	initIdentityTest(t)
+
+	session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "ALICE"}); !errors.Is(err, ErrAliasTaken) {
+		t.Fatalf("Expected ErrAliasTaken. Got %v", err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice", Secret: "secret"}); !errors.Is(err, ErrAliasTaken) {
+		t.Fatalf("Expected ErrAliasTaken registering an alias in use. Got %v", err)
+	}
+
+	// Free again once the session ends
+	InvalidateSession(session.Id)
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisteredAliasNeedsSecret(t *testing.T) {
+	path := initIdentityTest(t)
+
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice", Secret: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "hunter2") {
+		t.Fatal("Secret stored in plain text")
+	}
+
+	// Survives restarts
+	if err := InitIdentityService(IdentityServiceConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice"}); !errors.Is(err, ErrAliasTaken) {
+		t.Fatalf("Expected ErrAliasTaken without secret. Got %v", err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice", Secret: "wrong"}); !errors.Is(err, ErrWrongSecret) {
+		t.Fatalf("Expected ErrWrongSecret. Got %v", err)
+	}
+
+	// Any number of sessions can use a registered alias
+	for range 2 {
+		session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "Alice", Secret: "hunter2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Alias != "alice" {
+			t.Fatalf("Expected the registered alias 'alice'. Got '%s'", session.Alias)
+		}
+	}
+}
+
+func TestInvalidAlias(t *testing.T) {
+	initIdentityTest(t)
+
+	for _, alias := range []string{strings.Repeat("a", MaxAliasLength+1), "tab\tbed"} {
+		if _, err := ClaimIdentity(alias, ""); !errors.Is(err, ErrInvalidAlias) {
+			t.Fatalf("Expected ErrInvalidAlias for %q. Got %v", alias, err)
+		}
+	}
+	if _, err := ClaimIdentity("alice", strings.Repeat("s", MaxSecretLength+1)); !errors.Is(err, ErrInvalidSecret) {
+		t.Fatalf("Expected ErrInvalidSecret. Got %v", err)
+	}
+}
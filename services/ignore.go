@@ -0,0 +1,240 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sunkit02/filete/logging"
+)
+
+// Files holding .gitignore style patterns that are honored in every directory
+// of a shared directory with ignore files enabled
+var IgnoreFileNames = []string{".gitignore", ".fileteignore"}
+
+var ErrIgnoredFile = errors.New("File is excluded by an ignore pattern")
+
+// A single pattern of an ignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// Patterns without a slash match the name of a file at any depth,
+	// others match the path relative to base
+	matchName bool
+	// Directory of the ignore file the rule comes from, relative to the shared
+	// directory and separated by '/'. Empty for the root and global rules.
+	base string
+}
+
+// Decides whether files are ignored following the semantics of .gitignore: the
+// last matching rule wins and rules from deeper directories come later.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// Parses .gitignore style patterns relative to base. Invalid patterns are
+// logged and skipped.
+func parseIgnorePatterns(lines []string, base string) []ignoreRule {
+	rules := make([]ignoreRule, 0, len(lines))
+	for _, line := range lines {
+		rule, ok, err := parseIgnorePattern(line, base)
+		if err != nil {
+			logging.Warning.Printf("Skipping invalid ignore pattern '%s': %v", line, err)
+			continue
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func parseIgnorePattern(line, base string) (ignoreRule, bool, error) {
+	line = strings.TrimRight(line, "\r")
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false, nil
+	}
+
+	rule.matchName = !strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	pattern, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return ignoreRule{}, false, err
+	}
+	rule.pattern = pattern
+
+	return rule, true, nil
+}
+
+// Translates a .gitignore glob into a regular expression. '*' and '?' don't
+// match '/', while "**" matches across directories.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// Leading "**/" and "/**/" match zero or more directories
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return sb.String()
+}
+
+// Reports whether the file at relPath, relative to the shared directory and
+// separated by '/', is ignored.
+func (m ignoreMatcher) ignored(relPath string, isDir bool) bool {
+	if relPath == "" || relPath == "." {
+		return false
+	}
+
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		target := relPath
+		if rule.base != "" {
+			if !strings.HasPrefix(relPath, rule.base+"/") {
+				continue
+			}
+			target = strings.TrimPrefix(relPath, rule.base+"/")
+		}
+		if rule.matchName {
+			target = path.Base(target)
+		}
+
+		if rule.pattern.MatchString(target) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// Returns a matcher that additionally applies the ignore files inside the
+// directory at dirPath, relative path relDir.
+func (m ignoreMatcher) withDir(dirPath, relDir string) ignoreMatcher {
+	var added []ignoreRule
+	for _, name := range IgnoreFileNames {
+		lines, err := readLines(filepath.Join(dirPath, name))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				logging.Warning.Printf("Failed to read ignore file in %s: %v", dirPath, err)
+			}
+			continue
+		}
+		added = append(added, parseIgnorePatterns(lines, relDir)...)
+	}
+
+	if len(added) == 0 {
+		return m
+	}
+
+	// Copy so matchers of sibling directories don't share rules
+	rules := make([]ignoreRule, 0, len(m.rules)+len(added))
+	rules = append(rules, m.rules...)
+	rules = append(rules, added...)
+	return ignoreMatcher{rules: rules}
+}
+
+// Returns the matcher applying to the entries of the directory at relDir
+func (rootDir SharedRootDir) ignoreMatcher(relDir string) ignoreMatcher {
+	m := ignoreMatcher{rules: rootDir.excludes}
+	if !rootDir.IgnoreFiles {
+		return m
+	}
+
+	m = m.withDir(rootDir.realPath, "")
+	if relDir == "" || relDir == "." {
+		return m
+	}
+
+	current, currentRel := rootDir.realPath, ""
+	for _, component := range strings.Split(relDir, "/") {
+		current = filepath.Join(current, component)
+		currentRel = path.Join(currentRel, component)
+		m = m.withDir(current, currentRel)
+	}
+
+	return m
+}
+
+// Same as ignoreMatcher.withDir but only reads ignore files if enabled for
+// the shared directory
+func (rootDir SharedRootDir) enterDir(m ignoreMatcher, dirPath, relDir string) ignoreMatcher {
+	if !rootDir.IgnoreFiles {
+		return m
+	}
+	return m.withDir(dirPath, relDir)
+}
+
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	m := ignoreMatcher{rules: append(
+		parseIgnorePatterns([]string{
+			"# comment",
+			"",
+			"*.log",
+			"!keep.log",
+			"build/",
+			"/root-only.txt",
+			"docs/*.tmp",
+			"**/cache",
+			"a/**/z",
+			"file?.bin",
+			"[abc].txt",
+			"\\#hash",
+		}, ""),
+		parseIgnorePatterns([]string{"local.txt", "/anchored"}, "sub")...,
+	)}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{path: "debug.log", expected: true},
+		{path: "deep/dir/debug.log", expected: true},
+		{path: "keep.log", expected: false},
+		{path: "build", isDir: true, expected: true},
+		{path: "build", isDir: false, expected: false},
+		{path: "src/build", isDir: true, expected: true},
+		{path: "root-only.txt", expected: true},
+		{path: "sub/root-only.txt", expected: false},
+		{path: "docs/x.tmp", expected: true},
+		{path: "docs/deep/x.tmp", expected: false},
+		{path: "cache", isDir: true, expected: true},
+		{path: "x/y/cache", isDir: true, expected: true},
+		{path: "a/z", expected: true},
+		{path: "a/b/c/z", expected: true},
+		{path: "file1.bin", expected: true},
+		{path: "file10.bin", expected: false},
+		{path: "b.txt", expected: true},
+		{path: "d.txt", expected: false},
+		{path: "#hash", expected: true},
+		{path: "sub/local.txt", expected: true},
+		{path: "sub/deeper/local.txt", expected: true},
+		{path: "local.txt", expected: false},
+		{path: "sub/anchored", expected: true},
+		{path: "sub/deeper/anchored", expected: false},
+		{path: "", isDir: true, expected: false},
+	}
+
+	for _, test := range tests {
+		if got := m.ignored(test.path, test.isDir); got != test.expected {
+			t.Errorf("ignored(%q, %v): expected %v. Got %v", test.path, test.isDir, test.expected, got)
+		}
+	}
+}
+
+// Creates the following tree and shares it with ignore files enabled:
+//
+//	root/
+//	  .gitignore      (*.log, !keep.log)
+//	  app.log
+//	  keep.log
+//	  notes.txt
+//	  secret.key      (globally excluded)
+//	  sub/.fileteignore (data/)
+//	  sub/data/file.txt
+//	  sub/file.txt
+func setupIgnoreTree(t *testing.T, ignoreFiles bool) string {
+	root := filepath.Join(t.TempDir(), "root")
+	files := map[string]string{
+		".gitignore":        "*.log\n!keep.log\n",
+		"app.log":           "log",
+		"keep.log":          "log",
+		"notes.txt":         "notes",
+		"secret.key":        "key",
+		"sub/.fileteignore": "data/\n",
+		"sub/data/file.txt": "data",
+		"sub/file.txt":      "file",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := InitDownloadService(DownloadServiceConfig{
+		SharedDirectories: []SharedDirectoryConfig{{Path: root, IgnoreFiles: ignoreFiles}},
+		Excludes:          []string{"*.key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestReadDirHonorsIgnoreFiles(t *testing.T) {
+	for _, ignoreFiles := range []bool{true, false} {
+		root := setupIgnoreTree(t, ignoreFiles)
+
+		dir, err := ReadDir(adminSession, "", hashSHA256(root), 2)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+
+		listed := make([]string, 0)
+		for _, child := range dir.Children {
+			listed = append(listed, child.Path)
+			for _, grandChild := range child.Children {
+				listed = append(listed, grandChild.Path)
+			}
+		}
+
+		// secret.key is excluded globally, regardless of ignore files
+		expected := []string{"sub", "sub/file.txt", "keep.log", "notes.txt"}
+		if !ignoreFiles {
+			expected = []string{"sub", "sub/data", "sub/file.txt", "app.log", "keep.log", "notes.txt"}
+		}
+		if !reflect.DeepEqual(listed, expected) {
+			t.Errorf("Ignore files %v: expected %v. Got %v", ignoreFiles, expected, listed)
+		}
+	}
+}
+
+func TestIgnoredFilesCantBeDownloaded(t *testing.T) {
+	root := setupIgnoreTree(t, true)
+	hash := hashSHA256(root)
+
+	for _, path := range []string{"app.log", "secret.key", "sub/data", "sub/data/file.txt"} {
+		if _, err := GetFileInfo(adminSession, path, hash); !errors.Is(err, ErrIgnoredFile) {
+			t.Errorf("GetFileInfo(adminSession, %s): expected %v. Got %v", path, ErrIgnoredFile, err)
+		}
+	}
+	if _, err := GetFileInfo(adminSession, "keep.log", hash); err != nil {
+		t.Errorf("GetFileInfo(adminSession, keep.log): expected no error. Got %v", err)
+	}
+}
+
+func TestArchiveHonorsIgnoreFiles(t *testing.T) {
+	root := setupIgnoreTree(t, true)
+
+	format, err := ParseArchiveFormat("tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	err = WriteDirectoryArchive(context.Background(), &buffer, format, adminSession, "", hashSHA256(root))
+	if err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	names := make([]string, 0)
+	reader := tar.NewReader(&buffer)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+
+	expected := []string{"root/", "root/keep.log", "root/notes.txt", "root/sub/", "root/sub/file.txt"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v. Got %v", expected, names)
+	}
+}
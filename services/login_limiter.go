@@ -0,0 +1,236 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sunkit02/filete/logging"
+)
+
+var ErrTooManyAttempts = errors.New("Too many failed login attempts")
+
+// Returned instead of checking the credentials while a client, or everyone,
+// has to wait before trying again. Matches ErrTooManyAttempts with errors.Is.
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("%s, retry in %s", ErrTooManyAttempts, e.RetryAfter.Round(time.Second))
+}
+
+func (e *TooManyAttemptsError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// Limits failed logins. Zero fields use the matching Default* value.
+type LoginLimits struct {
+	// Failed attempts per client before backing off
+	FreeAttempts int
+	// Wait after the first failure beyond FreeAttempts, doubled with every
+	// further failure up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Failed attempts after which a client is locked out for LockoutDuration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Failed attempts from all clients together allowed per GlobalWindow.
+	// Guards against guessing from many addresses.
+	GlobalLimit  int
+	GlobalWindow time.Duration
+	// Replace the session key after this many wrong keys, e.g. on untrusted
+	// networks. Disabled if 0.
+	RotateKeyAfter int
+}
+
+const (
+	DefaultFreeAttempts    = 3
+	DefaultBaseBackoff     = 1 * time.Second
+	DefaultMaxBackoff      = 1 * time.Minute
+	DefaultLockoutAfter    = 10
+	DefaultLockoutDuration = 15 * time.Minute
+	DefaultGlobalLimit     = 100
+	DefaultGlobalWindow    = 1 * time.Minute
+	// Wait of clients sending another secret while one is still checked
+	SecretCheckRetryAfter = 1 * time.Second
+)
+
+type clientAttempts struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time
+}
+
+type loginLimiter struct {
+	lock   sync.Mutex
+	limits LoginLimits
+
+	clients map[string]*clientAttempts
+	// Clients whose secret is being checked
+	checkingSecret map[string]bool
+
+	windowStart    time.Time
+	windowFailures int
+
+	// Wrong keys since the key was last rotated
+	keyFailures int
+}
+
+func newLoginLimiter(limits LoginLimits) *loginLimiter {
+	if limits.FreeAttempts == 0 {
+		limits.FreeAttempts = DefaultFreeAttempts
+	}
+	if limits.BaseBackoff == 0 {
+		limits.BaseBackoff = DefaultBaseBackoff
+	}
+	if limits.MaxBackoff == 0 {
+		limits.MaxBackoff = DefaultMaxBackoff
+	}
+	if limits.LockoutAfter == 0 {
+		limits.LockoutAfter = DefaultLockoutAfter
+	}
+	if limits.LockoutDuration == 0 {
+		limits.LockoutDuration = DefaultLockoutDuration
+	}
+	if limits.GlobalLimit == 0 {
+		limits.GlobalLimit = DefaultGlobalLimit
+	}
+	if limits.GlobalWindow == 0 {
+		limits.GlobalWindow = DefaultGlobalWindow
+	}
+
+	return &loginLimiter{
+		limits:         limits,
+		clients:        make(map[string]*clientAttempts),
+		checkingSecret: make(map[string]bool),
+	}
+}
+
+// Returns a *TooManyAttemptsError if the client has to wait before trying
+// again
+func (l *loginLimiter) check(client string, now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.windowFailures >= l.limits.GlobalLimit {
+		if windowEnd := l.windowStart.Add(l.limits.GlobalWindow); now.Before(windowEnd) {
+			return &TooManyAttemptsError{RetryAfter: windowEnd.Sub(now)}
+		}
+	}
+
+	if attempts, ok := l.clients[client]; ok && now.Before(attempts.nextAllowed) {
+		return &TooManyAttemptsError{RetryAfter: attempts.nextAllowed.Sub(now)}
+	}
+
+	return nil
+}
+
+// Records a failed attempt and returns true if the session key has to be
+// rotated. wrongKey is false for failures of other credentials, e.g. the
+// secret of an identity.
+func (l *loginLimiter) fail(client string, wrongKey bool, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	attempts, ok := l.clients[client]
+	if !ok {
+		attempts = &clientAttempts{}
+		l.clients[client] = attempts
+	}
+	// Failures of clients already backing off or locked out are limited by
+	// that. Counting them as well would let a single client block logins for
+	// everyone and rotate the key as often as it likes.
+	limited := attempts.failures >= l.limits.FreeAttempts
+
+	attempts.failures++
+	attempts.lastFailure = now
+	logging.Warning.Printf("Failed login from %s (%d in a row)", client, attempts.failures)
+
+	switch {
+	case attempts.failures >= l.limits.LockoutAfter:
+		logging.Warning.Printf("Locking out %s for %s", client, l.limits.LockoutDuration)
+		attempts.nextAllowed = now.Add(l.limits.LockoutDuration)
+		// Back to backing off once the lockout is over
+		attempts.failures = l.limits.FreeAttempts
+	case attempts.failures > l.limits.FreeAttempts:
+		exponent := float64(attempts.failures - l.limits.FreeAttempts - 1)
+		backoff := time.Duration(float64(l.limits.BaseBackoff) * math.Pow(2, exponent))
+		attempts.nextAllowed = now.Add(min(backoff, l.limits.MaxBackoff))
+	}
+
+	if limited {
+		return false
+	}
+
+	if now.Sub(l.windowStart) >= l.limits.GlobalWindow {
+		l.windowStart = now
+		l.windowFailures = 0
+	}
+	l.windowFailures++
+	if l.windowFailures == l.limits.GlobalLimit {
+		logging.Warning.Printf("%d failed logins within %s, blocking all logins until %s",
+			l.windowFailures, l.limits.GlobalWindow, l.windowStart.Add(l.limits.GlobalWindow).Format(time.TimeOnly))
+	}
+
+	if !wrongKey || l.limits.RotateKeyAfter == 0 {
+		return false
+	}
+	l.keyFailures++
+	if l.keyFailures < l.limits.RotateKeyAfter {
+		return false
+	}
+	l.keyFailures = 0
+	return true
+}
+
+// Marks a secret of the client as being checked. Returns false if one is
+// checked already, as clients could otherwise check any number of secrets in
+// parallel before the first failure is recorded.
+func (l *loginLimiter) startSecretCheck(client string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.checkingSecret[client] {
+		return false
+	}
+	l.checkingSecret[client] = true
+	return true
+}
+
+func (l *loginLimiter) endSecretCheck(client string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.checkingSecret, client)
+}
+
+// Forgets the failures of a client that logged in with a key of role. Only
+// the admin key, which every failed guess could have been aimed at, clears
+// them. Otherwise holders of any key could keep guessing the admin key by
+// logging in with their own in between.
+func (l *loginLimiter) succeed(client string, role Role) {
+	if role != RoleAdmin {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.clients, client)
+}
+
+// Forgets clients that are allowed to try again and haven't failed for a
+// while, so the map doesn't grow forever
+func (l *loginLimiter) prune(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for client, attempts := range l.clients {
+		if now.After(attempts.nextAllowed) && now.Sub(attempts.lastFailure) > l.limits.LockoutDuration {
+			delete(l.clients, client)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterBacksOff(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{FreeAttempts: 2, BaseBackoff: time.Second, MaxBackoff: 4 * time.Second})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		l.fail("a", true, now)
+		if err := l.check("a", now); err != nil {
+			t.Fatalf("Expected free attempt %d to be allowed. Got %v", i+1, err)
+		}
+	}
+
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		l.fail("a", true, now)
+		var tooMany *TooManyAttemptsError
+		err := l.check("a", now)
+		if !errors.As(err, &tooMany) || tooMany.RetryAfter != expected {
+			t.Fatalf("Expected to wait %s. Got %v", expected, err)
+		}
+		if !errors.Is(err, ErrTooManyAttempts) {
+			t.Fatalf("Expected %v to match ErrTooManyAttempts", err)
+		}
+		if err := l.check("a", now.Add(expected)); err != nil {
+			t.Fatalf("Expected to be allowed after %s. Got %v", expected, err)
+		}
+	}
+
+	if err := l.check("b", now); err != nil {
+		t.Fatalf("Expected other clients to be allowed. Got %v", err)
+	}
+
+	l.succeed("a", RoleAdmin)
+	if err := l.check("a", now); err != nil {
+		t.Fatalf("Expected to be allowed after logging in. Got %v", err)
+	}
+}
+
+func TestLowerKeysDontResetFailures(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{FreeAttempts: 3})
+	now := time.Now()
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 3; i++ {
+			l.fail("a", true, now)
+		}
+		// Logging in with an uploader key in between must not grant 3 more
+		// guesses at the admin key
+		l.succeed("a", RoleUploader)
+	}
+	if err := l.check("a", now); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected to back off. Got %v", err)
+	}
+
+	l.succeed("a", RoleAdmin)
+	if err := l.check("a", now); err != nil {
+		t.Fatalf("Expected the admin key to clear the failures. Got %v", err)
+	}
+}
+
+func TestLoginLimiterLocksOut(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{LockoutAfter: 5, LockoutDuration: time.Hour})
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		l.fail("a", false, now)
+	}
+	if err := l.check("a", now.Add(59*time.Minute)); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected to be locked out. Got %v", err)
+	}
+
+	later := now.Add(time.Hour)
+	if err := l.check("a", later); err != nil {
+		t.Fatalf("Expected the lockout to be over. Got %v", err)
+	}
+	// Backs off right away instead of granting the free attempts again
+	l.fail("a", false, later)
+	if err := l.check("a", later); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected to back off after the lockout. Got %v", err)
+	}
+}
+
+func TestLoginLimiterGlobalLimit(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{GlobalLimit: 3, GlobalWindow: time.Minute})
+	now := time.Now()
+
+	for _, client := range []string{"a", "b", "c"} {
+		l.fail(client, true, now)
+	}
+	if err := l.check("d", now.Add(30*time.Second)); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected all clients to be blocked. Got %v", err)
+	}
+	if err := l.check("d", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Expected logins to be allowed in the next window. Got %v", err)
+	}
+}
+
+func TestSingleClientCantBlockEveryone(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{FreeAttempts: 2, GlobalLimit: 3, RotateKeyAfter: 3})
+	now := time.Now()
+
+	for i := 0; i < 2*DefaultLockoutAfter; i++ {
+		if l.fail("a", true, now) {
+			t.Fatalf("Expected failures of a client backing off not to rotate the key. Rotated after %d", i+1)
+		}
+	}
+	if err := l.check("b", now); err != nil {
+		t.Fatalf("Expected other clients to be allowed. Got %v", err)
+	}
+
+	if !l.fail("b", true, now) {
+		t.Fatal("Expected the key to be rotated after a failure of another client")
+	}
+	if err := l.check("c", now); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected all clients to be blocked. Got %v", err)
+	}
+}
+
+func TestLoginLimiterRotatesKey(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{RotateKeyAfter: 2})
+	now := time.Now()
+
+	if l.fail("a", false, now) || l.fail("a", false, now) {
+		t.Fatal("Expected wrong secrets not to rotate the key")
+	}
+	if l.fail("a", true, now) {
+		t.Fatal("Expected the key not to be rotated after 1 wrong key")
+	}
+	if !l.fail("b", true, now) {
+		t.Fatal("Expected the key to be rotated after 2 wrong keys")
+	}
+	if l.fail("c", true, now) {
+		t.Fatal("Expected the count to restart after rotating")
+	}
+
+	if newLoginLimiter(LoginLimits{}).fail("a", true, now) {
+		t.Fatal("Expected rotation to be disabled by default")
+	}
+}
+
+func TestLoginLimiterPrune(t *testing.T) {
+	l := newLoginLimiter(LoginLimits{LockoutDuration: time.Hour})
+	now := time.Now()
+
+	l.fail("old", true, now)
+	l.fail("recent", true, now.Add(30*time.Minute))
+	l.prune(now.Add(time.Hour + time.Second))
+
+	if _, ok := l.clients["old"]; ok {
+		t.Fatal("Expected the old client to be forgotten")
+	}
+	if _, ok := l.clients["recent"]; !ok {
+		t.Fatal("Expected the recent client to be kept")
+	}
+}
+
+func TestAuthenticateRotatesKey(t *testing.T) {
+	initIdentityTest(t)
+	if err := InitAuthService(AuthServiceConfig{Limits: LoginLimits{RotateKeyAfter: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	key := SessionKey()
+
+	for i := 0; i < 2; i++ {
+		_, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "wrong"})
+		if !errors.Is(err, ErrInvalidSessionKey) {
+			t.Fatalf("Expected ErrInvalidSessionKey. Got %v", err)
+		}
+	}
+
+	if SessionKey() == key {
+		t.Fatal("Expected the session key to be rotated")
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.2", SessionKey: key}); !errors.Is(err, ErrInvalidSessionKey) {
+		t.Fatalf("Expected the old key to be rejected. Got %v", err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.2", SessionKey: SessionKey()}); err != nil {
+		t.Fatalf("Expected the new key to be accepted. Got %v", err)
+	}
+}
+
+func TestOneSecretCheckPerClient(t *testing.T) {
+	initIdentityTest(t)
+	limiter.startSecretCheck("10.0.0.1")
+
+	attempt := LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "key", Alias: "alice", Secret: "secret"}
+	if _, err := AuthenticateWithSessionKey(attempt); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected ErrTooManyAttempts while a secret is checked. Got %v", err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "key"}); err != nil {
+		t.Fatalf("Expected logins without secret to be allowed. Got %v", err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.2", SessionKey: "key", Alias: "bob", Secret: "secret"}); err != nil {
+		t.Fatalf("Expected other clients to be allowed. Got %v", err)
+	}
+
+	limiter.endSecretCheck("10.0.0.1")
+	if _, err := AuthenticateWithSessionKey(attempt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuthenticateWithSessionKey(LoginAttempt{ClientIp: "10.0.0.1", SessionKey: "key", Alias: "bob", Secret: "wrong"}); !errors.Is(err, ErrWrongSecret) {
+		t.Fatalf("Expected ErrWrongSecret. Got %v", err)
+	}
+	if len(limiter.checkingSecret) != 0 {
+		t.Fatalf("Expected no secret checks left. Got %v", limiter.checkingSecret)
+	}
+}
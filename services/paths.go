@@ -0,0 +1,104 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidRootDir  = errors.New("Invalid rootDirHash")
+	ErrInvalidPath     = errors.New("Invalid path")
+	ErrPathOutsideRoot = errors.New("Path is outside of the shared directory")
+)
+
+// Resolves a client supplied path, relative to the shared root directory and
+// separated by '/', into the canonical path of the file on disk.
+//
+// Absolute paths and paths with ".." components are rejected outright, even
+// if they would end up inside the root. Symlinks are resolved and the result
+// has to stay inside the real path of the root so links can't be used to
+// escape it either. Hidden files and symlinks are only reachable if the policy
+// of the shared directory allows it.
+func (rootDir SharedRootDir) resolve(path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", ErrInvalidPath
+	}
+
+	nativePath := filepath.FromSlash(path)
+	if strings.HasPrefix(path, "/") || filepath.IsAbs(nativePath) || filepath.VolumeName(nativePath) != "" {
+		return "", ErrInvalidPath
+	}
+
+	for _, component := range strings.Split(filepath.ToSlash(nativePath), "/") {
+		if component == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+
+	if err := rootDir.checkPolicy(nativePath); err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(rootDir.realPath, nativePath))
+	if err != nil {
+		return "", err
+	}
+
+	if err := rootDir.checkResolved(resolved); err != nil {
+		return "", err
+	}
+
+	return resolved, nil
+}
+
+// Returns the real path of a shared root directory with all symlinks resolved
+func realRootPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New(path + " is not a directory")
+	}
+
+	return realPath, nil
+}
+
+// Joins a path relative to a shared directory with the name of a child
+func joinRelPath(relPath, name string) string {
+	if relPath == "" {
+		return name
+	}
+	return relPath + "/" + name
+}
+
+// Returns the parent of a path relative to a shared directory. The parent of
+// top level files is the root, "".
+func parentRelPath(relPath string) string {
+	if i := strings.LastIndex(relPath, "/"); i >= 0 {
+		return relPath[:i]
+	}
+	return ""
+}
+
+// Reports whether path is root or inside of it. Both must be clean.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Creates the following tree and returns the shared root and the directory
+// next to it that must never be reachable:
+//
+//	root/
+//	  inside/file.txt
+//	  inside/up -> ../..
+//	  internal -> inside/file.txt
+//	  escape -> ../outside
+//	  absolute -> <outside>/secret.txt
+//	outside/secret.txt
+func setupResolveTree(t *testing.T) (SharedRootDir, string) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+
+	for _, dir := range []string{filepath.Join(root, "inside"), outside} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "inside", "file.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(file, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "inside", "up"): "../..",
+		filepath.Join(root, "internal"):     "inside/file.txt",
+		filepath.Join(root, "escape"):       "../outside",
+		filepath.Join(root, "absolute"):     filepath.Join(outside, "secret.txt"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	realPath, err := realRootPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return SharedRootDir{Id: "root", Path: root, Symlinks: SymlinksFollow, realPath: realPath}, outside
+}
+
+func TestResolve(t *testing.T) {
+	rootDir, _ := setupResolveTree(t)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string // relative to the root, only checked if err is nil
+		err      error
+	}{
+		{name: "root", path: "", expected: "."},
+		{name: "dot", path: ".", expected: "."},
+		{name: "directory", path: "inside", expected: "inside"},
+		{name: "file", path: "inside/file.txt", expected: "inside/file.txt"},
+		{name: "leading dot", path: "./inside/file.txt", expected: "inside/file.txt"},
+		{name: "double slash", path: "inside//file.txt", expected: "inside/file.txt"},
+		{name: "trailing slash", path: "inside/", expected: "inside"},
+		{name: "symlink inside root", path: "internal", expected: "inside/file.txt"},
+
+		{name: "parent", path: "..", err: ErrInvalidPath},
+		{name: "parent with slash", path: "../", err: ErrInvalidPath},
+		{name: "parents", path: "../../etc", err: ErrInvalidPath},
+		{name: "parent after directory", path: "inside/../../outside", err: ErrInvalidPath},
+		{name: "parent staying inside", path: "inside/../inside", err: ErrInvalidPath},
+		{name: "trailing parent", path: "inside/..", err: ErrInvalidPath},
+		{name: "absolute", path: "/etc/passwd", err: ErrInvalidPath},
+		{name: "nul byte", path: "inside/file.txt\x00.png", err: ErrInvalidPath},
+		{name: "symlink to outside directory", path: "escape", err: ErrPathOutsideRoot},
+		{name: "file through symlink to outside", path: "escape/secret.txt", err: ErrPathOutsideRoot},
+		{name: "absolute symlink to outside", path: "absolute", err: ErrPathOutsideRoot},
+		{name: "symlink to parent", path: "inside/up", err: ErrPathOutsideRoot},
+		{name: "through symlink to parent", path: "inside/up/outside/secret.txt", err: ErrPathOutsideRoot},
+
+		{name: "missing", path: "missing", err: fs.ErrNotExist},
+		{name: "encoded parent is a plain name", path: "%2e%2e/etc", err: fs.ErrNotExist},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := rootDir.resolve(test.path)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("Expected error %v. Got %v (resolved to %s)", test.err, err, resolved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expected := filepath.Join(rootDir.realPath, filepath.FromSlash(test.expected))
+			if resolved != expected {
+				t.Fatalf("Expected %s. Got %s", expected, resolved)
+			}
+		})
+	}
+}
+
+func TestSharedFileFunctionsRejectEscapes(t *testing.T) {
+	rootDir, _ := setupResolveTree(t)
+
+	err := InitDownloadService(DownloadServiceConfig{
+		SharedDirectories: []SharedDirectoryConfig{{Path: rootDir.Path, Symlinks: SymlinksFollow}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDirHash := hashSHA256(rootDir.Path)
+
+	for _, path := range []string{"..", "../outside", "escape", "escape/secret.txt", "/etc"} {
+		if _, err := ReadDir(adminSession, path, rootDirHash, 1); err == nil {
+			t.Errorf("ReadDir(%q) succeeded", path)
+		}
+		if _, err := GetFileInfo(adminSession, path, rootDirHash); err == nil {
+			t.Errorf("GetFileInfo(%q) succeeded", path)
+		}
+		if file, _, err := GetFileForDownload(adminSession, path, rootDirHash); err == nil {
+			file.Close()
+			t.Errorf("GetFileForDownload(%q) succeeded", path)
+		}
+		if _, err := ResolveBatchDownload(adminSession, []BatchDownloadItem{{RootDirHash: rootDirHash, Path: path}}); err == nil {
+			t.Errorf("ResolveBatchDownload(%q) succeeded", path)
+		}
+	}
+}
+
+func TestSharePolicies(t *testing.T) {
+	rootDir, _ := setupResolveTree(t)
+	if err := os.MkdirAll(filepath.Join(rootDir.Path, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".ssh", filepath.Join(rootDir.Path, "keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		symlinks   SymlinkPolicy
+		showHidden bool
+		path       string
+		err        error
+	}{
+		{name: "hidden", symlinks: SymlinksFollow, path: ".ssh", err: ErrHiddenFile},
+		{name: "hidden shown", symlinks: SymlinksFollow, showHidden: true, path: ".ssh"},
+		{name: "symlink to hidden", symlinks: SymlinksFollow, path: "keys", err: ErrHiddenFile},
+		{name: "symlink to hidden shown", symlinks: SymlinksFollow, showHidden: true, path: "keys"},
+		{name: "followed", symlinks: SymlinksFollow, path: "internal"},
+		{name: "listed", symlinks: SymlinksList, path: "internal", err: ErrSymlinkNotAllowed},
+		{name: "hidden symlink", symlinks: SymlinksHide, path: "internal", err: fs.ErrNotExist},
+		{name: "regular file", symlinks: SymlinksHide, path: "inside/file.txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rootDir.Symlinks = test.symlinks
+			rootDir.ShowHidden = test.showHidden
+
+			_, err := rootDir.resolve(test.path)
+			if test.err == nil && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			} else if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v. Got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestReadDirAppliesSharePolicy(t *testing.T) {
+	rootDir, _ := setupResolveTree(t)
+	if err := os.WriteFile(filepath.Join(rootDir.Path, ".env"), []byte("SECRET=1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		symlinks SymlinkPolicy
+		expected map[string]bool // name -> isSymlink
+	}{
+		// escape and absolute point outside of the root and are never listed
+		{symlinks: SymlinksFollow, expected: map[string]bool{"inside": false, "internal": false}},
+		{symlinks: SymlinksList, expected: map[string]bool{
+			"inside": false, "internal": true, "escape": true, "absolute": true,
+		}},
+		{symlinks: SymlinksHide, expected: map[string]bool{"inside": false}},
+	} {
+		err := InitDownloadService(DownloadServiceConfig{
+			SharedDirectories: []SharedDirectoryConfig{{Path: rootDir.Path, Symlinks: test.symlinks}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir, err := ReadDir(adminSession, "", hashSHA256(rootDir.Path), 1)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+
+		listed := make(map[string]bool, len(dir.Children))
+		for _, child := range dir.Children {
+			listed[child.Name] = child.IsSymlink
+		}
+		if !reflect.DeepEqual(listed, test.expected) {
+			t.Errorf("Policy %s: expected %v. Got %v", test.symlinks, test.expected, listed)
+		}
+	}
+}
+
+func TestArchiveAppliesSharePolicy(t *testing.T) {
+	rootDir, _ := setupResolveTree(t)
+	if err := os.WriteFile(filepath.Join(rootDir.Path, "inside", ".env"), []byte("SECRET=1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := InitDownloadService(DownloadServiceConfig{
+		SharedDirectories: []SharedDirectoryConfig{{Path: rootDir.Path, Symlinks: SymlinksFollow}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format, err := ParseArchiveFormat("tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	err = WriteDirectoryArchive(context.Background(), &buffer, format, adminSession, "", hashSHA256(rootDir.Path))
+	if err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	names := make([]string, 0)
+	reader := tar.NewReader(&buffer)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+
+	// inside/up points to an ancestor, escape and absolute outside of the root
+	expected := []string{"root/", "root/inside/", "root/inside/file.txt", "root/internal"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v. Got %v", expected, names)
+	}
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Types of the events reporting the progress of running transfers
+const (
+	EventUploadProgress   = "upload-progress"
+	EventDownloadProgress = "download-progress"
+)
+
+// Minimum time between two progress events of the same transfer
+const ProgressInterval = 500 * time.Millisecond
+
+type TransferProgress struct {
+	// Upload id for resumable uploads, request id otherwise
+	TransferId  string `json:"transferId"`
+	Name        string `json:"name"`
+	Transferred int64  `json:"transferred"`
+	// -1 if unknown, e.g. for archives which are written while walking
+	Total int64 `json:"total"`
+	// Set in the last event of a transfer
+	Done bool `json:"done"`
+}
+
+// Publishes progress events of a single transfer, at most one every
+// ProgressInterval. The events only go to the session doing the transfer as
+// they name the file.
+type ProgressTracker struct {
+	lock       sync.Mutex
+	eventType  string
+	sessionId  string
+	progress   TransferProgress
+	lastReport time.Time
+}
+
+func NewUploadProgress(session UserSession, transferId, name string, total int64) *ProgressTracker {
+	return newProgressTracker(EventUploadProgress, session, transferId, name, total)
+}
+
+func NewDownloadProgress(session UserSession, transferId, name string, total int64) *ProgressTracker {
+	return newProgressTracker(EventDownloadProgress, session, transferId, name, total)
+}
+
+func newProgressTracker(eventType string, session UserSession, transferId, name string, total int64) *ProgressTracker {
+	return &ProgressTracker{
+		eventType: eventType,
+		sessionId: session.Id,
+		progress:  TransferProgress{TransferId: transferId, Name: name, Total: total},
+	}
+}
+
+// Records n more transferred bytes
+func (t *ProgressTracker) Add(n int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.progress.Transferred += n
+	if time.Since(t.lastReport) >= ProgressInterval {
+		t.publish()
+	}
+}
+
+// Sets the total once it is known, e.g. from the Content-Length of a response
+func (t *ProgressTracker) SetTotal(total int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progress.Total = total
+}
+
+// Publishes the current progress regardless of when the last event was sent
+func (t *ProgressTracker) Flush() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.publish()
+}
+
+// Publishes the final progress of the transfer
+func (t *ProgressTracker) Finish() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progress.Done = true
+	t.publish()
+}
+
+func (t *ProgressTracker) publish() {
+	t.lastReport = time.Now()
+	PublishEvent(Event{Type: t.eventType, Data: t.progress, SessionId: t.sessionId})
+}
+
+// Returns a reader recording every byte read from r
+func (t *ProgressTracker) Reader(r io.Reader) io.Reader {
+	return &progressReader{Reader: r, tracker: t}
+}
+
+// Returns a writer recording every byte written to w
+func (t *ProgressTracker) Writer(w io.Writer) io.Writer {
+	return &progressWriter{Writer: w, tracker: t}
+}
+
+type progressReader struct {
+	io.Reader
+	tracker *ProgressTracker
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.Add(int64(n))
+	return n, err
+}
+
+type progressWriter struct {
+	io.Writer
+	tracker *ProgressTracker
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.tracker.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Decides what a session may do. Every session key maps to a role, see
+// SessionKeyConfig.
+type Role string
+
+const (
+	// Browses the shares and reads messages
+	RoleViewer Role = "viewer"
+	// Only uploads files, e.g. guests dropping files off
+	RoleUploader Role = "uploader"
+	// Everything but managing messages
+	RoleContributor Role = "contributor"
+	// Everything. The role of the main session key.
+	RoleAdmin Role = "admin"
+)
+
+func ParseRole(s string) (Role, error) {
+	switch role := Role(s); role {
+	case RoleViewer, RoleUploader, RoleContributor, RoleAdmin:
+		return role, nil
+	default:
+		return "", fmt.Errorf("Invalid role '%s'. Must be one of viewer, uploader, contributor or admin", s)
+	}
+}
+
+type Permission string
+
+const (
+	// List shared directories and download from them
+	PermissionBrowse Permission = "browse"
+	PermissionUpload Permission = "upload"
+	// Read messages, their attachments and the event streams
+	PermissionReadMessages Permission = "read-messages"
+	PermissionPostMessages Permission = "post-messages"
+	// Delete messages of anyone
+	PermissionManageMessages Permission = "manage-messages"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:      {PermissionBrowse, PermissionReadMessages},
+	RoleUploader:    {PermissionUpload},
+	RoleContributor: {PermissionBrowse, PermissionUpload, PermissionReadMessages, PermissionPostMessages},
+	RoleAdmin: {
+		PermissionBrowse, PermissionUpload, PermissionReadMessages, PermissionPostMessages,
+		PermissionManageMessages,
+	},
+}
+
+// Unknown roles, e.g. of sessions persisted by older versions, can't do
+// anything
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
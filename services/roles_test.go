@@ -0,0 +1,41 @@
+package services
+
+import "testing"
+
+func TestRolePermissions(t *testing.T) {
+	tests := []struct {
+		role    Role
+		allowed []Permission
+		denied  []Permission
+	}{
+		{RoleViewer, []Permission{PermissionBrowse, PermissionReadMessages}, []Permission{PermissionUpload, PermissionPostMessages}},
+		{RoleUploader, []Permission{PermissionUpload}, []Permission{PermissionBrowse, PermissionReadMessages, PermissionPostMessages}},
+		{RoleContributor, []Permission{PermissionBrowse, PermissionUpload, PermissionPostMessages}, []Permission{PermissionManageMessages}},
+		{RoleAdmin, []Permission{PermissionBrowse, PermissionUpload, PermissionPostMessages, PermissionManageMessages}, nil},
+		{"", nil, []Permission{PermissionBrowse, PermissionUpload}},
+	}
+
+	for _, test := range tests {
+		for _, permission := range test.allowed {
+			if !test.role.Can(permission) {
+				t.Fatalf("Expected role '%s' to have permission %s", test.role, permission)
+			}
+		}
+		for _, permission := range test.denied {
+			if test.role.Can(permission) {
+				t.Fatalf("Expected role '%s' not to have permission %s", test.role, permission)
+			}
+		}
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	if role, err := ParseRole("uploader"); err != nil || role != RoleUploader {
+		t.Fatalf("Expected uploader. Got '%s', %v", role, err)
+	}
+	for _, s := range []string{"", "Admin", "root"} {
+		if _, err := ParseRole(s); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// Backend keeping the sessions
+type SessionStoreType string
+
+const (
+	// Sessions are lost when the server stops
+	SessionStoreMemory SessionStoreType = "memory"
+	// Sessions are persisted in a file and survive restarts
+	SessionStoreFile SessionStoreType = "file"
+)
+
+const DefaultSessionStore = SessionStoreMemory
+
+// Name of the file of SessionStoreFile inside the data directory
+const SessionFileName = "sessions.json"
+
+func ParseSessionStore(s string) (SessionStoreType, error) {
+	switch store := SessionStoreType(s); store {
+	case SessionStoreMemory, SessionStoreFile:
+		return store, nil
+	case "":
+		return DefaultSessionStore, nil
+	default:
+		return "", fmt.Errorf("Invalid session store '%s'. Must be one of memory or file", s)
+	}
+}
+
+// Keeps the sessions of the auth service. Implementations must be safe for
+// concurrent use. Expired sessions are removed by the auth service with
+// DeleteExpired.
+type SessionStore interface {
+	Get(id string) (UserSession, bool, error)
+	GetAll() ([]UserSession, error)
+	// Adds the session or replaces the one with the same id
+	Put(session UserSession) error
+	// Returns false if there is no session with the id
+	Delete(id string) (bool, error)
+	// Removes every session expired at now and returns how many were removed
+	DeleteExpired(now time.Time) (int, error)
+	Close() error
+}
+
+type MemorySessionStore struct {
+	lock     sync.RWMutex
+	sessions map[string]UserSession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]UserSession)}
+}
+
+func (store *MemorySessionStore) Get(id string) (UserSession, bool, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	session, exists := store.sessions[id]
+	return session, exists, nil
+}
+
+func (store *MemorySessionStore) GetAll() ([]UserSession, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	sessions := make([]UserSession, 0, len(store.sessions))
+	for _, session := range store.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (store *MemorySessionStore) Put(session UserSession) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.sessions[session.Id] = session
+	return nil
+}
+
+func (store *MemorySessionStore) Delete(id string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, exists := store.sessions[id]
+	delete(store.sessions, id)
+	return exists, nil
+}
+
+func (store *MemorySessionStore) DeleteExpired(now time.Time) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	removed := 0
+	for id, session := range store.sessions {
+		if session.IsExpired(now) {
+			delete(store.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (store *MemorySessionStore) Close() error {
+	return nil
+}
+
+// Keeps the sessions in memory and rewrites the whole file on every change.
+// Sessions only change on login, logout and expiry so this stays cheap. The
+// file holds valid session ids and is only readable by the owner.
+type FileSessionStore struct {
+	// Serializes changes so the file is written in the same order
+	lock     sync.Mutex
+	path     string
+	sessions *MemorySessionStore
+}
+
+// Loads the sessions in the file at path, dropping expired ones. The file is
+// created on the first change.
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	store := &FileSessionStore{path: path, sessions: NewMemorySessionStore()}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sessions []UserSession
+	if err := json.Unmarshal(content, &sessions); err != nil {
+		return nil, fmt.Errorf("Failed to read sessions from %s: %w", path, err)
+	}
+
+	now := time.Now()
+	for _, session := range sessions {
+		if !session.IsExpired(now) {
+			store.sessions.Put(session)
+		}
+	}
+
+	return store, nil
+}
+
+func (store *FileSessionStore) Get(id string) (UserSession, bool, error) {
+	return store.sessions.Get(id)
+}
+
+func (store *FileSessionStore) GetAll() ([]UserSession, error) {
+	return store.sessions.GetAll()
+}
+
+func (store *FileSessionStore) Put(session UserSession) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.sessions.Put(session)
+	return store.save()
+}
+
+func (store *FileSessionStore) Delete(id string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	exists, _ := store.sessions.Delete(id)
+	if !exists {
+		return false, nil
+	}
+	return true, store.save()
+}
+
+func (store *FileSessionStore) DeleteExpired(now time.Time) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	removed, _ := store.sessions.DeleteExpired(now)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, store.save()
+}
+
+func (store *FileSessionStore) Close() error {
+	return nil
+}
+
+// Atomically replaces the file with the current sessions. Must be called with
+// the lock held.
+func (store *FileSessionStore) save() error {
+	sessions, _ := store.sessions.GetAll()
+	content, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := store.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, store.path)
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunkit02/filete/web/types"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	now := time.Now()
+	active := UserSession{Id: "active", Expires: now.Add(time.Hour), Alias: "alice"}
+	expired := UserSession{Id: "expired", Expires: now.Add(-time.Second), Alias: "bob"}
+
+	for _, session := range []UserSession{active, expired} {
+		if err := store.Put(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, exists, err := store.Get("active")
+	if err != nil || !exists || got.Alias != "alice" || !got.Expires.Equal(active.Expires) {
+		t.Fatalf("Expected %+v. Got %+v, %v, %v", active, got, exists, err)
+	}
+
+	removed, err := store.DeleteExpired(now)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected 1 expired session to be removed. Got %d, %v", removed, err)
+	}
+	if all, _ := store.GetAll(); len(all) != 1 || all[0].Id != "active" {
+		t.Fatalf("Expected only the active session. Got %+v", all)
+	}
+
+	existed, err := store.Delete("active")
+	if err != nil || !existed {
+		t.Fatalf("Expected the session to be deleted. Got %v, %v", existed, err)
+	}
+	if existed, _ := store.Delete("active"); existed {
+		t.Fatal("Expected deleting a missing session to report false")
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SessionFileName)
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the session file to only be readable by the owner. Got %v", info.Mode())
+	}
+}
+
+func TestFileSessionStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SessionFileName)
+	config := AuthServiceConfig{SessionKey: "key", SessionStore: SessionStoreFile, SessionFile: path}
+	if err := InitAuthService(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitIdentityService(IdentityServiceConfig{Path: filepath.Join(t.TempDir(), "identities.json")}); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key", Alias: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expired before the restart, must not come back
+	sessions.Put(UserSession{Id: "expired", Expires: time.Now().Add(-time.Minute)})
+
+	if err := InitAuthService(config); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, ok := ValidateSessionCookie(http.Cookie{Name: types.SessionIdCookieName, Value: session.Id})
+	if !ok || restored.Alias != "alice" {
+		t.Fatalf("Expected session of alice to survive the restart. Got %+v, %v", restored, ok)
+	}
+	if _, exists, _ := sessions.Get("expired"); exists {
+		t.Fatal("Expected expired session to be dropped on load")
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	initIdentityTest(t)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := AuthenticateWithSessionKey(LoginAttempt{SessionKey: "key"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cookie := http.Cookie{Name: types.SessionIdCookieName, Value: session.Id}
+			if _, ok := ValidateSessionCookie(cookie); !ok {
+				t.Error("Expected a valid session")
+			}
+			InvalidateSession(session.Id)
+		}()
+	}
+	wg.Wait()
+
+	if all, _ := sessions.GetAll(); len(all) != 0 {
+		t.Fatalf("Expected no sessions left. Got %d", len(all))
+	}
+}
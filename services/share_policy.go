@@ -0,0 +1,158 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// How symlinks inside a shared directory are treated
+type SymlinkPolicy string
+
+const (
+	// Symlinks are listed as their target and can be navigated into and
+	// downloaded, as long as the target is inside the shared directory
+	SymlinksFollow SymlinkPolicy = "follow"
+	// Symlinks are listed and archived as links but their targets can't be
+	// accessed through them
+	SymlinksList SymlinkPolicy = "list"
+	// Symlinks are neither listed, archived nor followed
+	SymlinksHide SymlinkPolicy = "hide"
+)
+
+const DefaultSymlinkPolicy = SymlinksFollow
+
+var (
+	ErrHiddenFile        = errors.New("File is hidden")
+	ErrSymlinkNotAllowed = errors.New("Symlinks are not followed in this shared directory")
+)
+
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	switch policy := SymlinkPolicy(strings.ToLower(s)); policy {
+	case SymlinksFollow, SymlinksList, SymlinksHide:
+		return policy, nil
+	case "":
+		return DefaultSymlinkPolicy, nil
+	default:
+		return "", fmt.Errorf("Invalid symlink policy '%s'. Must be one of follow, list or hide", s)
+	}
+}
+
+// Reports whether session may list and download from the shared directory.
+// Admins may access every directory. Aliases only count for sessions that
+// proved to be a configured identity, as anyone can claim or register other
+// aliases.
+func (rootDir SharedRootDir) allows(session UserSession) bool {
+	if session.Role == RoleAdmin || (len(rootDir.AllowedRoles) == 0 && len(rootDir.AllowedAliases) == 0) {
+		return true
+	}
+	if slices.Contains(rootDir.AllowedRoles, session.Role) {
+		return true
+	}
+
+	for _, alias := range rootDir.AllowedAliases {
+		if strings.EqualFold(alias, session.Alias) {
+			return session.Verified && isConfiguredAlias(session.Alias)
+		}
+	}
+	return false
+}
+
+// Reports whether a dotfile is hidden by the policy of the shared directory
+func (rootDir SharedRootDir) hides(name string) bool {
+	return !rootDir.ShowHidden && strings.HasPrefix(name, ".")
+}
+
+// Checks every component of a client supplied path, already known to be free
+// of ".." components, against the policy and ignore patterns of the shared
+// directory.
+func (rootDir SharedRootDir) checkPolicy(nativePath string) error {
+	current, currentRel := rootDir.realPath, ""
+	ignores := rootDir.ignoreMatcher("")
+	for _, component := range strings.Split(nativePath, string(filepath.Separator)) {
+		if component == "" || component == "." {
+			continue
+		}
+		if rootDir.hides(component) {
+			return ErrHiddenFile
+		}
+
+		current = filepath.Join(current, component)
+		currentRel = joinRelPath(currentRel, component)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return err
+		}
+
+		isDir := info.IsDir()
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch rootDir.Symlinks {
+			case SymlinksHide:
+				return os.ErrNotExist
+			case SymlinksList:
+				return ErrSymlinkNotAllowed
+			}
+
+			_, targetInfo, err := rootDir.followLink(current)
+			if err != nil {
+				return err
+			}
+			isDir = targetInfo.IsDir()
+		}
+
+		if ignores.ignored(currentRel, isDir) {
+			return ErrIgnoredFile
+		}
+		if isDir {
+			ignores = rootDir.enterDir(ignores, current, currentRel)
+		}
+	}
+
+	return nil
+}
+
+// Checks that a resolved path, e.g. the target of a symlink, is inside the
+// shared directory and not hidden.
+func (rootDir SharedRootDir) checkResolved(resolved string) error {
+	if !isWithin(rootDir.realPath, resolved) {
+		return ErrPathOutsideRoot
+	}
+
+	relPath, err := filepath.Rel(rootDir.realPath, resolved)
+	if err != nil {
+		return err
+	}
+	for _, component := range strings.Split(relPath, string(filepath.Separator)) {
+		if component != "." && rootDir.hides(component) {
+			return ErrHiddenFile
+		}
+	}
+
+	return nil
+}
+
+// Returns the resolved path and info of the target of the symlink at path if
+// the policy of the shared directory allows following it.
+func (rootDir SharedRootDir) followLink(path string) (string, os.FileInfo, error) {
+	if rootDir.Symlinks != SymlinksFollow {
+		return "", nil, ErrSymlinkNotAllowed
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := rootDir.checkResolved(resolved); err != nil {
+		return "", nil, err
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return resolved, info, nil
+}
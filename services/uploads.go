@@ -0,0 +1,457 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
+)
+
+// Name of the directory inside the upload directory holding upload state
+const UploadStateDirName = ".uploads"
+
+var (
+	ErrUploadNotFound  = errors.New("Upload not found")
+	ErrUploadLocked    = errors.New("Upload is being written to by another request")
+	ErrOffsetMismatch  = errors.New("Upload offset doesn't match the received bytes")
+	ErrUploadTooLarge  = errors.New("Upload exceeds its declared length")
+	ErrUploadCompleted = errors.New("Upload is already complete")
+
+	ErrUploadIncomplete   = errors.New("Upload is not complete")
+	ErrUploadNotOwned     = errors.New("Upload was created by another session")
+	ErrTooManyAttachments = errors.New("Too many attachments")
+)
+
+// Maximum number of uploads a single message can reference
+const MaxAttachments = 20
+
+var (
+	uploadDir      string
+	uploadStateDir string
+
+	busyUploadsLock sync.Mutex
+	// Ids of the uploads being written to or deleted. Ids are removed once
+	// done, so ids sent by clients don't pile up.
+	busyUploads = make(map[string]bool)
+)
+
+type UploadServiceConfig struct {
+	// Directory completed uploads are saved to
+	UploadDir string
+}
+
+// Upload is a resumable upload whose content is received in chunks. Its state
+// is persisted under the upload directory so uploads survive server restarts.
+type Upload struct {
+	Id       string            `json:"id"`
+	FileName string            `json:"fileName"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+	// Hash of the id of the session that created the upload. The id itself
+	// isn't stored as it grants access to the session.
+	Owner string `json:"owner"`
+
+	// Number of bytes received so far. Derived from the partial file on disk
+	// instead of being persisted so it is correct even after a crash.
+	Offset int64 `json:"-"`
+
+	// Path of the saved file. Empty until the upload is complete
+	SavedPath string `json:"savedPath,omitempty"`
+}
+
+func (u Upload) IsComplete() bool {
+	return u.SavedPath != ""
+}
+
+// Reports whether session created the upload
+func (u Upload) IsOwnedBy(session UserSession) bool {
+	return u.Owner != "" && u.Owner == uploadOwner(session)
+}
+
+// Reports whether session may resume, inspect or delete the upload
+func (u Upload) IsManageableBy(session UserSession) bool {
+	return u.IsOwnedBy(session) || session.Role == RoleAdmin
+}
+
+func uploadOwner(session UserSession) string {
+	if session.Id == "" {
+		return ""
+	}
+	return hashSHA256(session.Id)
+}
+
+func InitUploadService(c UploadServiceConfig) error {
+	uploadDir = c.UploadDir
+	uploadStateDir = filepath.Join(c.UploadDir, UploadStateDirName)
+
+	return os.MkdirAll(uploadStateDir, 0755)
+}
+
+// Creates a new empty upload of the given length owned by session. The file
+// name is taken from the "filename" or "name" metadata entries.
+func CreateUpload(session UserSession, length int64, metadata map[string]string) (Upload, error) {
+	if length < 0 {
+		return Upload{}, fmt.Errorf("Invalid upload length %d", length)
+	}
+
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+
+	upload := Upload{
+		Id:       uuid.New().String(),
+		FileName: sanitizeFileName(fileName),
+		Length:   length,
+		Metadata: metadata,
+		Created:  time.Now().UTC(),
+		Owner:    uploadOwner(session),
+	}
+
+	partFile, err := os.OpenFile(upload.partPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return Upload{}, err
+	}
+	partFile.Close()
+
+	if err := upload.saveInfo(); err != nil {
+		os.Remove(upload.partPath())
+		return Upload{}, err
+	}
+
+	// Nothing to wait for with empty files
+	if length == 0 {
+		return finishUpload(upload)
+	}
+
+	return upload, nil
+}
+
+// Returns the upload with the given id. An upload that received all of its
+// bytes without being saved, e.g. after a crash, is saved first.
+func GetUpload(id string) (Upload, error) {
+	upload, err := readUpload(id)
+	if err != nil || upload.IsComplete() || upload.Offset < upload.Length {
+		return upload, err
+	}
+
+	unlock, ok := tryLockUpload(id)
+	if !ok {
+		// Being written to, the writer saves it
+		return upload, nil
+	}
+	defer unlock()
+
+	// Read again, the writer may have saved it in the meantime
+	upload, err = readUpload(id)
+	if err != nil || upload.IsComplete() || upload.Offset < upload.Length {
+		return upload, err
+	}
+	return finishUpload(upload)
+}
+
+func readUpload(id string) (Upload, error) {
+	// Ids are only ever generated by us so anything else can't be a valid
+	// upload and must not be used to build a path
+	if uuid.Validate(id) != nil {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	content, err := os.ReadFile(infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Upload{}, ErrUploadNotFound
+	} else if err != nil {
+		return Upload{}, err
+	}
+
+	var upload Upload
+	if err := json.Unmarshal(content, &upload); err != nil {
+		return Upload{}, err
+	}
+
+	if upload.IsComplete() {
+		upload.Offset = upload.Length
+		return upload, nil
+	}
+
+	info, err := os.Stat(upload.partPath())
+	if err != nil {
+		return Upload{}, err
+	}
+	upload.Offset = info.Size()
+
+	return upload, nil
+}
+
+// Appends the content of r to the upload with the given id. offset must match
+// the number of bytes already received. Bytes received before r fails are kept
+// so the client can resume from the returned offset. The upload is saved to
+// the upload directory once all bytes have been received.
+func WriteUploadChunk(session UserSession, id string, offset int64, r io.Reader) (Upload, error) {
+	unlock, err := lockExistingUpload(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer unlock()
+
+	// An upload with all bytes received but not saved yet is saved below
+	upload, err := readUpload(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if upload.IsComplete() {
+		return upload, ErrUploadCompleted
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+
+	partFile, err := os.OpenFile(upload.partPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return upload, err
+	}
+	defer partFile.Close()
+
+	progress := NewUploadProgress(session, upload.Id, upload.FileName, upload.Length)
+	progress.Add(upload.Offset)
+	defer func() {
+		if upload.Offset == upload.Length {
+			progress.Finish()
+		} else {
+			progress.Flush()
+		}
+	}()
+
+	remaining := upload.Length - upload.Offset
+	// Read one extra byte to detect clients sending more than declared
+	written, copyErr := io.Copy(partFile, progress.Reader(io.LimitReader(r, remaining+1)))
+	if written > remaining {
+		if err := partFile.Truncate(upload.Length); err != nil {
+			return upload, err
+		}
+		written = remaining
+		copyErr = ErrUploadTooLarge
+	}
+	upload.Offset += written
+
+	if err := partFile.Sync(); err != nil {
+		return upload, err
+	}
+
+	// Saved even if r failed or sent too much, all declared bytes are there
+	if upload.Offset == upload.Length {
+		partFile.Close()
+		upload, err = finishUpload(upload)
+		if err != nil {
+			return upload, err
+		}
+	}
+
+	return upload, copyErr
+}
+
+// Creates an upload and writes all of r to it at once, e.g. for files that
+// were received completely in a single request. Nothing is kept if r ends
+// early or fails.
+func SaveUpload(session UserSession, fileName string, length int64, r io.Reader) (Upload, error) {
+	upload, err := CreateUpload(session, length, map[string]string{"filename": fileName})
+	if err != nil {
+		return Upload{}, err
+	}
+	if upload.IsComplete() {
+		return upload, nil
+	}
+
+	upload, err = WriteUploadChunk(session, upload.Id, 0, r)
+	if err == nil && !upload.IsComplete() {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if deleteErr := DeleteUpload(upload.Id); deleteErr != nil {
+			logging.Error.Printf("Failed to remove failed upload %s: %v", upload.Id, deleteErr)
+		}
+		return Upload{}, err
+	}
+
+	return upload, nil
+}
+
+// Opens the saved file of a completed upload
+func OpenUpload(id string) (*os.File, Upload, error) {
+	upload, err := GetUpload(id)
+	if err != nil {
+		return nil, Upload{}, err
+	}
+	if !upload.IsComplete() {
+		return nil, Upload{}, ErrUploadIncomplete
+	}
+
+	file, err := os.Open(upload.SavedPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed from the upload directory by hand
+		return nil, Upload{}, ErrUploadNotFound
+	} else if err != nil {
+		return nil, Upload{}, err
+	}
+
+	return file, upload, nil
+}
+
+// Fills in the file name and size of attachments referencing completed
+// uploads by id. Attachments referencing the same upload are only kept once.
+// Only uploads created by session can be attached, so upload ids that leak
+// can't be used to expose files sent by others.
+func ResolveAttachments(session UserSession, attachments []data.Attachment) ([]data.Attachment, error) {
+	if len(attachments) > MaxAttachments {
+		return nil, ErrTooManyAttachments
+	}
+
+	resolved := make([]data.Attachment, 0, len(attachments))
+	seen := make(map[string]bool, len(attachments))
+	for _, attachment := range attachments {
+		if seen[attachment.UploadId] {
+			continue
+		}
+		seen[attachment.UploadId] = true
+
+		upload, err := GetUpload(attachment.UploadId)
+		if err != nil {
+			return nil, err
+		}
+		if !upload.IsOwnedBy(session) {
+			return nil, ErrUploadNotOwned
+		}
+		if !upload.IsComplete() {
+			return nil, ErrUploadIncomplete
+		}
+
+		resolved = append(resolved, data.Attachment{
+			UploadId: upload.Id,
+			FileName: upload.FileName,
+			Size:     upload.Length,
+		})
+	}
+
+	return resolved, nil
+}
+
+// Removes an upload and everything saved for it
+func DeleteUpload(id string) error {
+	unlock, err := lockExistingUpload(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	upload, err := readUpload(id)
+	if err != nil {
+		return err
+	}
+
+	if upload.IsComplete() {
+		err = os.Remove(upload.SavedPath)
+	} else {
+		err = os.Remove(upload.partPath())
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.Remove(infoPath(id))
+}
+
+// Moves a fully received upload into the upload directory
+func finishUpload(upload Upload) (Upload, error) {
+	// The id keeps uploads of the same name finishing at once from replacing
+	// each other
+	savedPath := filepath.Join(uploadDir, fmt.Sprintf("%d-%s-%s", time.Now().UnixMilli(), upload.Id, upload.FileName))
+	if err := os.Rename(upload.partPath(), savedPath); err != nil {
+		return upload, err
+	}
+
+	upload.SavedPath = savedPath
+	if err := upload.saveInfo(); err != nil {
+		return upload, err
+	}
+
+	logging.Info.Printf("Upload %s complete, saved to %s", upload.Id, savedPath)
+	PublishEvent(Event{
+		Type: EventUploadCompleted,
+		Data: UploadCompletedEvent{FileName: upload.FileName, Size: upload.Length},
+	})
+	return upload, nil
+}
+
+// Atomically replaces the persisted info of the upload
+func (u Upload) saveInfo() error {
+	content, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := infoPath(u.Id) + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, infoPath(u.Id))
+}
+
+// Marks the upload as busy and returns a function to release it. Returns
+// false if it is busy already.
+func tryLockUpload(id string) (func(), bool) {
+	busyUploadsLock.Lock()
+	defer busyUploadsLock.Unlock()
+
+	if busyUploads[id] {
+		return nil, false
+	}
+	busyUploads[id] = true
+
+	return func() {
+		busyUploadsLock.Lock()
+		defer busyUploadsLock.Unlock()
+		delete(busyUploads, id)
+	}, true
+}
+
+// Like tryLockUpload, but only for uploads that exist. The upload has to be
+// read again once locked.
+func lockExistingUpload(id string) (func(), error) {
+	if _, err := readUpload(id); err != nil {
+		return nil, err
+	}
+
+	unlock, ok := tryLockUpload(id)
+	if !ok {
+		return nil, ErrUploadLocked
+	}
+	return unlock, nil
+}
+
+func (u Upload) partPath() string {
+	return filepath.Join(uploadStateDir, u.Id+".part")
+}
+
+func infoPath(id string) string {
+	return filepath.Join(uploadStateDir, id+".info")
+}
+
+// Strips directories from a client provided file name
+func sanitizeFileName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		return "upload"
+	}
+	return name
+}
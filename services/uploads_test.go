@@ -0,0 +1,312 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sunkit02/filete/data"
+)
+
+// Owner of the uploads created in tests
+var uploaderSession = UserSession{Id: "uploader"}
+
+func TestResumableUpload(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitUploadService(UploadServiceConfig{UploadDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "Hello, resumable world"
+	upload, err := CreateUpload(uploaderSession, int64(len(content)), map[string]string{"filename": "../hello.txt"})
+	if err != nil {
+		t.Fatalf("Failed to create upload: %v", err)
+	}
+	if upload.FileName != "hello.txt" {
+		t.Fatalf("Expected file name hello.txt. Got %s", upload.FileName)
+	}
+
+	upload, err = WriteUploadChunk(uploaderSession, upload.Id, 0, strings.NewReader(content[:5]))
+	if err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	if upload.Offset != 5 {
+		t.Fatalf("Expected offset 5. Got %d", upload.Offset)
+	}
+
+	// State must survive a restart of the service
+	if err := InitUploadService(UploadServiceConfig{UploadDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err = GetUpload(upload.Id)
+	if err != nil {
+		t.Fatalf("Failed to get upload: %v", err)
+	}
+	if upload.Offset != 5 {
+		t.Fatalf("Expected offset 5 after restart. Got %d", upload.Offset)
+	}
+
+	_, err = WriteUploadChunk(uploaderSession, upload.Id, 0, strings.NewReader(content))
+	if !errors.Is(err, ErrOffsetMismatch) {
+		t.Fatalf("Expected %v. Got %v", ErrOffsetMismatch, err)
+	}
+
+	upload, err = WriteUploadChunk(uploaderSession, upload.Id, 5, strings.NewReader(content[5:]))
+	if err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	if !upload.IsComplete() {
+		t.Fatalf("Expected upload to be complete: %+v", upload)
+	}
+
+	saved, err := os.ReadFile(upload.SavedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != content {
+		t.Fatalf("Expected %q. Got %q", content, string(saved))
+	}
+
+	_, err = WriteUploadChunk(uploaderSession, upload.Id, upload.Offset, strings.NewReader("more"))
+	if !errors.Is(err, ErrUploadCompleted) {
+		t.Fatalf("Expected %v. Got %v", ErrUploadCompleted, err)
+	}
+}
+
+func TestUploadRejectsExtraBytes(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := CreateUpload(uploaderSession, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err = WriteUploadChunk(uploaderSession, upload.Id, 0, strings.NewReader("abcdef"))
+	if !errors.Is(err, ErrUploadTooLarge) {
+		t.Fatalf("Expected %v. Got %v", ErrUploadTooLarge, err)
+	}
+	if upload.Offset != 3 {
+		t.Fatalf("Expected offset 3. Got %d", upload.Offset)
+	}
+	if !upload.IsComplete() {
+		t.Fatalf("Expected the declared bytes to be saved: %+v", upload)
+	}
+}
+
+func TestGetUploadSavesReceivedUpload(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := CreateUpload(uploaderSession, 5, map[string]string{"filename": "crash.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if the server crashed between writing the last chunk and saving
+	if err := os.WriteFile(upload.partPath(), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err = GetUpload(upload.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upload.IsComplete() || upload.Offset != 5 {
+		t.Fatalf("Expected the upload to be saved: %+v", upload)
+	}
+	saved, err := os.ReadFile(upload.SavedPath)
+	if err != nil || string(saved) != "hello" {
+		t.Fatalf("Expected hello to be saved. Got %q, %v", saved, err)
+	}
+}
+
+func TestGetUploadRejectsInvalidIds(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := GetUpload("../../etc/passwd")
+	if !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("Expected %v. Got %v", ErrUploadNotFound, err)
+	}
+}
+
+func TestSaveUploadAndResolveAttachments(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := SaveUpload(uploaderSession, "../build.log", 5, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upload.IsComplete() || upload.FileName != "build.log" {
+		t.Fatalf("Expected a complete upload named build.log. Got %+v", upload)
+	}
+
+	file, _, err := OpenUpload(upload.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	attachments, err := ResolveAttachments(uploaderSession, []data.Attachment{
+		{UploadId: upload.Id, FileName: "spoofed", Size: 1},
+		{UploadId: upload.Id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Attachment{UploadId: upload.Id, FileName: "build.log", Size: 5}
+	if len(attachments) != 1 || attachments[0] != expected {
+		t.Fatalf("Expected only %+v. Got %+v", expected, attachments)
+	}
+
+	// Incomplete and unknown uploads can't be attached
+	partial, err := CreateUpload(uploaderSession, 10, map[string]string{"filename": "partial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveAttachments(uploaderSession, []data.Attachment{{UploadId: partial.Id}}); !errors.Is(err, ErrUploadIncomplete) {
+		t.Fatalf("Expected ErrUploadIncomplete. Got %v", err)
+	}
+	if _, err := ResolveAttachments(uploaderSession, []data.Attachment{{UploadId: "missing"}}); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("Expected ErrUploadNotFound. Got %v", err)
+	}
+
+	// Upload ids can leak, e.g. through progress events, so they must not be
+	// enough to attach someone else's file
+	other := UserSession{Id: "other"}
+	if _, err := ResolveAttachments(other, []data.Attachment{{UploadId: upload.Id}}); !errors.Is(err, ErrUploadNotOwned) {
+		t.Fatalf("Expected ErrUploadNotOwned. Got %v", err)
+	}
+}
+
+func TestSaveUploadDiscardsShortFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitUploadService(UploadServiceConfig{UploadDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SaveUpload(uploaderSession, "short", 10, strings.NewReader("hello")); err == nil {
+		t.Fatal("Expected an error for a file shorter than declared")
+	}
+
+	entries, err := os.ReadDir(uploadStateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected the upload to be removed. Found %v", entries)
+	}
+}
+
+func TestUploadsOfTheSameNameAreKept(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := SaveUpload(uploaderSession, "same.txt", 5, strings.NewReader("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SaveUpload(uploaderSession, "same.txt", 6, strings.NewReader("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.SavedPath == second.SavedPath {
+		t.Fatalf("Expected both uploads to be saved separately. Got %s", first.SavedPath)
+	}
+	for path, expected := range map[string]string{first.SavedPath: "first", second.SavedPath: "second"} {
+		saved, err := os.ReadFile(path)
+		if err != nil || string(saved) != expected {
+			t.Fatalf("Expected %q. Got %q, %v", expected, saved, err)
+		}
+	}
+}
+
+func TestUploadIsManageableByOwnerAndAdmins(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := CreateUpload(uploaderSession, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !upload.IsManageableBy(uploaderSession) {
+		t.Fatal("Expected the owner to manage the upload")
+	}
+	if !upload.IsManageableBy(UserSession{Id: "admin", Role: RoleAdmin}) {
+		t.Fatal("Expected admins to manage the upload")
+	}
+	if upload.IsManageableBy(UserSession{Id: "other", Role: RoleContributor}) {
+		t.Fatal("Expected other sessions not to manage the upload")
+	}
+}
+
+func TestResumableUploadFinishesProgress(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := CreateUpload(uploaderSession, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, unsubscribe := SubscribeEvents(uploaderSession)
+	defer unsubscribe()
+
+	if _, err := WriteUploadChunk(uploaderSession, upload.Id, 0, strings.NewReader("hel")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteUploadChunk(uploaderSession, upload.Id, 3, strings.NewReader("lo")); err != nil {
+		t.Fatal(err)
+	}
+
+	var last TransferProgress
+	for len(events) > 0 {
+		if event := <-events; event.Type == EventUploadProgress {
+			last = event.Data.(TransferProgress)
+		}
+	}
+	if !last.Done || last.Transferred != 5 {
+		t.Fatalf("Expected a final progress event with 5 bytes. Got %+v", last)
+	}
+}
+
+func TestUploadLocksAreReleased(t *testing.T) {
+	if err := InitUploadService(UploadServiceConfig{UploadDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := CreateUpload(uploaderSession, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, ok := tryLockUpload(upload.Id)
+	if !ok {
+		t.Fatal("Expected to lock the upload")
+	}
+	if _, err := WriteUploadChunk(uploaderSession, upload.Id, 0, strings.NewReader("hello")); !errors.Is(err, ErrUploadLocked) {
+		t.Fatalf("Expected %v. Got %v", ErrUploadLocked, err)
+	}
+	unlock()
+
+	for _, id := range []string{"bogus", "0b8e4a36-5f0e-4a47-a5a4-6e4f3d0c4e3e", upload.Id} {
+		WriteUploadChunk(uploaderSession, id, 0, strings.NewReader("hello"))
+		GetUpload(id)
+		DeleteUpload(id)
+	}
+
+	if len(busyUploads) != 0 {
+		t.Fatalf("Expected no upload to be locked. Got %v", busyUploads)
+	}
+}
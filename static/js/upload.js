@@ -6,6 +6,7 @@ const changeSessionKeyBtn = document.getElementById("change-session-key-btn")
 const sessionKeyDisplay = document.getElementById("session-key-display")
 const authenticateBtn = document.getElementById("authenticate-btn")
 const endSessionBtn = document.getElementById("end-session-btn")
+const aliasDisplay = document.getElementById("alias-display")
 
 authenticateBtn.addEventListener("click", () => {
   while (!sessionKey) {
@@ -17,18 +18,30 @@ authenticateBtn.addEventListener("click", () => {
     displaySessionKey()
   }
 
+  // Both optional: no alias gets a guest alias, a secret registers the alias
+  // or reclaims it
+  const alias = prompt("Alias (optional):") || ""
+  const secret = alias ? prompt("Secret to keep the alias (optional):") || "" : ""
+
   fetch("/auth/authenticate", {
     method: "POST",
     headers: {
       "Content-Type": "application/json"
     },
-    body: JSON.stringify({ sessionKey })
+    body: JSON.stringify({ sessionKey, alias, secret })
   })
     .then(async (res) => {
       if (!res.ok) {
         const msg = `Failed to authenticate: ${await res.text()}`
         alert(msg)
         console.error(msg)
+        return
+      }
+      const session = await res.json()
+      aliasDisplay.innerText = `${session.alias} (${session.role})`
+      // Uploaders can't read messages
+      if (session.role !== "uploader") {
+        connectEvents()
       }
     })
     .catch(err => console.error(err))
@@ -78,6 +91,7 @@ changeSessionKeyBtn.addEventListener("click", () => {
 const fileForm = document.getElementById("file-form");
 const messageForm = document.getElementById("message-form");
 const uploadResult = document.getElementById("upload-result");
+let pendingAttachments = []
 
 fileForm.addEventListener("submit", e => {
   e.preventDefault();
@@ -105,7 +119,10 @@ fileForm.addEventListener("submit", e => {
       if (res.status >= 400) {
         throw new Error(await res.text())
       }
-      uploadResult.innerText = await res.text();
+      // Attached to the next message sent
+      const uploads = await res.json()
+      pendingAttachments.push(...uploads.map(upload => ({ uploadId: upload.id })))
+      uploadResult.innerText = `${uploads.length} file(s) uploaded, attached to your next message`;
       setTimeout(() => {
         uploadResult.innerText = ""
       }, 2000);
@@ -140,13 +157,15 @@ messageForm.addEventListener("submit", e => {
       "Content-Type": "application/json",
       "Authorization": `Bearer ${sessionKey}`
     },
-    body: JSON.stringify({ body, timeSent }),
+    body: JSON.stringify({ body, timeSent, attachments: pendingAttachments }),
   })
     .then(async res => {
       if (res.status >= 400) {
         throw new Error(await res.text())
       }
-      uploadResult.innerText = await res.text();
+      await res.json();
+      pendingAttachments = []
+      uploadResult.innerText = "Message sent";
       setTimeout(() => {
         uploadResult.innerText = ""
       }, 2000);
@@ -159,5 +178,42 @@ messageForm.addEventListener("submit", e => {
 
 });
 
+const messagesList = document.getElementById("messages")
+let events = null
+let lastMessageId = 0
+
+// Streams new messages and uploads. Messages missed while disconnected are
+// replayed by the server based on the last message id received.
+function connectEvents() {
+  if (events) {
+    events.close()
+  }
+
+  events = new EventSource(`/api/events?last-event-id=${lastMessageId}`)
+  events.addEventListener("message-created", e => {
+    const message = JSON.parse(e.data)
+    if (message.id <= lastMessageId) {
+      return
+    }
+    lastMessageId = message.id
+
+    const item = document.createElement("li")
+    const sender = message.sender || "unknown"
+    item.innerText = `${new Date(message.timeSent).toLocaleTimeString()} ${sender}: ${message.body}`
+    for (const attachment of message.attachments || []) {
+      const link = document.createElement("a")
+      link.href = `/api/messages/${message.id}/attachments/${attachment.uploadId}`
+      link.innerText = attachment.fileName
+      item.append(" ", link)
+    }
+    messagesList.appendChild(item)
+  })
+  events.addEventListener("upload-completed", e => {
+    const upload = JSON.parse(e.data)
+    uploadResult.innerText = `Received ${upload.fileName}`
+  })
+}
+
 sessionKey = prompt("Session Key:")
 displaySessionKey()
+connectEvents()
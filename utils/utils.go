@@ -1,22 +1,73 @@
 package utils
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
 	"strings"
 )
 
-var alphanumerics = [...]rune{
-	'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I',
-	'J', 'K', 'L', 'M', 'N', 'O', 'P', 'q', 'r',
-	's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '1',
-	'2', '3', '4', '5', '6', '7', '8', '9', '0',
+// Crockford's base32 alphabet. Leaves out I, L, O and U so keys read out loud
+// or copied by hand are hard to get wrong.
+const Base32Alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Returns a URL safe token made of n bytes from crypto/rand, i.e. with 8n bits
+// of entropy
+func GenerateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func GenerateRandomString(length uint) string {
-	var key strings.Builder
+// Returns length characters picked uniformly from alphabet with crypto/rand
+func GenerateRandomString(alphabet string, length int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+
+	var s strings.Builder
 	for range length {
-		key.WriteRune(alphanumerics[rand.Intn(len(alphanumerics))])
+		i, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		s.WriteByte(alphabet[i.Int64()])
 	}
 
-	return key.String()
+	return s.String(), nil
+}
+
+// Returns groups of 4 base32 characters separated by dashes, e.g.
+// "7KQ2-M9XD-4TRB". Every group adds 20 bits of entropy.
+func GenerateGroupedKey(groups int) (string, error) {
+	key, err := GenerateRandomString(Base32Alphabet, groups*4)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, 0, groups)
+	for i := 0; i < len(key); i += 4 {
+		parts = append(parts, key[i:i+4])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// Undoes the mistakes people make typing a key of GenerateGroupedKey: case,
+// separators and letters that look like digits are ignored
+func NormalizeGroupedKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ':
+			return -1
+		case 'o', 'O':
+			return '0'
+		case 'i', 'I', 'l', 'L':
+			return '1'
+		}
+		if 'a' <= r && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, key)
 }
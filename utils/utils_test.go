@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGenerateToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 100 {
+		token, err := GenerateToken(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 32 bytes are 43 characters of unpadded base64
+		if len(token) != 43 {
+			t.Fatalf("Expected 43 characters. Got %q", token)
+		}
+		if seen[token] {
+			t.Fatalf("Duplicate token %q", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestGenerateGroupedKey(t *testing.T) {
+	key, err := GenerateGroupedKey(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}$`).MatchString(key) {
+		t.Fatalf("Unexpected key format %q", key)
+	}
+	if NormalizeGroupedKey(key) != key[0:4]+key[5:9]+key[10:14] {
+		t.Fatalf("Normalizing %q changed more than the separators", key)
+	}
+}
+
+func TestNormalizeGroupedKey(t *testing.T) {
+	if got := NormalizeGroupedKey("7kq2 m9xd-4tRB"); got != "7KQ2M9XD4TRB" {
+		t.Fatalf("Expected 7KQ2M9XD4TRB. Got %s", got)
+	}
+	if got := NormalizeGroupedKey("OiL0-1"); got != "01101" {
+		t.Fatalf("Expected look-alike letters to become digits. Got %s", got)
+	}
+}
@@ -2,13 +2,16 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
 	"net/http"
 	"os"
 	"strings"
-	"time"
 
+	"github.com/google/uuid"
 	"github.com/sunkit02/filete/data"
 	"github.com/sunkit02/filete/logging"
 	"github.com/sunkit02/filete/services"
@@ -18,19 +21,43 @@ import (
 
 func ApiRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /upload", handleFileUpload)
-	mux.HandleFunc("POST /message", handlePostMessage)
-	mux.HandleFunc("GET /shared-dir", handleGetSharedDir)
-	mux.HandleFunc("GET /download", handleFileDownload)
+	mux.Handle("POST /upload", requires(services.PermissionUpload, http.HandlerFunc(handleFileUpload)))
+	mux.Handle("POST /message", requires(services.PermissionPostMessages, http.HandlerFunc(handlePostMessage)))
+	mux.Handle("GET /shared-dir", requires(services.PermissionBrowse, http.HandlerFunc(handleGetSharedDir)))
+	mux.Handle("GET /download", requires(services.PermissionBrowse, http.HandlerFunc(handleFileDownload)))
+	mux.Handle("POST /download/batch", requires(services.PermissionBrowse, http.HandlerFunc(handleBatchDownload)))
+	registerUploadRoutes(mux)
+	registerMessageRoutes(mux)
+	registerEventRoutes(mux)
+	registerWebSocketRoutes(mux)
 
 	return mux
 }
 
+// Only lets sessions with permission through to next
+func requires(permission services.Permission, next http.Handler) http.Handler {
+	return middleware.PermissionMiddleware(permission, next)
+}
+
 const MaxFileSizeStoredInMemory = 32 << 20 // 32 MB
 
-// handleFileUpload processes file uploads
+// A file received by handleFileUpload. Id can be used to attach the file to
+// messages.
+type uploadedFile struct {
+	Id       string `json:"id"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+}
+
+// handleFileUpload processes file uploads and responds with the uploads
+// created for the files
 func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
+
+	// The files are received while parsing the form
+	progress := services.NewUploadProgress(session, id.String(), "", r.ContentLength)
+	r.Body = io.NopCloser(progress.Reader(r.Body))
 
 	err := r.ParseMultipartForm(MaxFileSizeStoredInMemory)
 	if err != nil {
@@ -45,11 +72,12 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	uploaded := make([]uploadedFile, 0)
 	for k, fileheaders := range r.MultipartForm.File {
 		logging.Debug.Println("Processing multipart fileheaders with key:", k)
 
 		for _, fileheader := range fileheaders {
-			uploadedFile, err := fileheader.Open()
+			file, err := fileheader.Open()
 			if err != nil {
 				logging.Error.Println(utils.WithId(id, "Failed to parse multipart file upload: %v", err))
 				http.Error(w, utils.WithId(id, "Failed to parse multipart file upload"), http.StatusBadRequest)
@@ -58,40 +86,25 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 
 			logging.Trace.Println("Processing uploaded file:", fileheader.Filename)
 
-			// Create a file on the server to save the uploaded file
-			saveFilePath := fmt.Sprintf("./uploaded/%d-%s", time.Now().UnixMilli(), fileheader.Filename)
-			saveFile, err := os.Create(saveFilePath)
+			// Saved like resumable uploads so the file gets an upload id
+			upload, err := services.SaveUpload(session, fileheader.Filename, fileheader.Size, file)
+			file.Close()
 			if err != nil {
-				logging.Error.Printf(utils.WithId(id, "Unable to save file with name '%s'", saveFilePath))
-				http.Error(w, utils.WithId(id, "Error saving file"), http.StatusInternalServerError)
-				return
-			}
-			defer saveFile.Close()
-
-			// Copy the file content to the new file
-			bytesWritten, err := io.Copy(saveFile, uploadedFile)
-			if err != nil {
-				logging.Error.Printf(utils.WithId(id, "Unable to copy file with name '%s'", saveFilePath))
-				http.Error(w, utils.WithId(id, "Error saving file"), http.StatusInternalServerError)
-				return
-			}
-
-			// Remove savefile if incomplete/corrupted
-			if bytesWritten != fileheader.Size {
-				err = os.Remove(saveFilePath)
-
-				logging.Error.Printf(utils.WithId(id,
-					"Saved file incomplete/corrupted. Uploaded size: %d, written: %d",
-					bytesWritten, fileheader.Size))
-
+				logging.Error.Println(utils.WithId(id, "Unable to save file with name '%s': %v", fileheader.Filename, err))
 				http.Error(w, utils.WithId(id, "Error saving file"), http.StatusInternalServerError)
 				return
 			}
 
+			uploaded = append(uploaded, uploadedFile{
+				Id:       upload.Id,
+				FileName: upload.FileName,
+				Size:     upload.Length,
+			})
 		}
 	}
 
-	fmt.Fprint(w, "File(s) uploaded successfully")
+	progress.Finish()
+	writeJSON(w, id, http.StatusCreated, uploaded)
 }
 
 func handlePostMessage(w http.ResponseWriter, r *http.Request) {
@@ -113,15 +126,20 @@ func handlePostMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = messageRepo.Add(message)
-	if err != nil {
+	session, _ := middleware.ExtractSession(r)
+	message, err = createMessage(message, session)
+	if isAttachmentError(err) {
+		http.Error(w, utils.WithId(id, "Invalid attachment: %v", err), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		logging.Error.Println(utils.WithId(id, "Failed to write new message to file"), err)
 		http.Error(w, utils.WithId(id, "Failed to send new message"), http.StatusInternalServerError)
+		return
 	}
 
-	fmt.Printf("Got message: %+v\n", message)
+	logging.Debug.Printf("Got message: %+v\n", message)
 
-	fmt.Fprint(w, "Message sent")
+	writeJSON(w, id, http.StatusCreated, message)
 }
 
 const DefaultReadDepth = 1
@@ -130,12 +148,13 @@ const DefaultReadDepth = 1
 // If `path` is empty, query parameter `root-dir-hash` is ignored
 func handleGetSharedDir(w http.ResponseWriter, r *http.Request) {
 	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
 
 	path := r.URL.Query().Get("path")
 
 	var responseBody []byte
 	if path == "" {
-		sharedDirs, err := services.ReadRootDirs(DefaultReadDepth)
+		sharedDirs, err := services.ReadRootDirs(session, DefaultReadDepth)
 		if err != nil {
 			logging.Error.Println(utils.WithId(id, err.Error()))
 			http.Error(w, utils.WithId(id, err.Error()), http.StatusInternalServerError)
@@ -149,10 +168,9 @@ func handleGetSharedDir(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		rootDirHash := r.URL.Query().Get("root-dir-hash")
-		sharedDir, err := services.ReadDir(path, rootDirHash, DefaultReadDepth)
+		sharedDir, err := services.ReadDir(session, path, rootDirHash, DefaultReadDepth)
 		if err != nil {
-			logging.Error.Println(utils.WithId(id, err.Error()))
-			http.Error(w, utils.WithId(id, err.Error()), http.StatusInternalServerError)
+			writeSharedFileError(w, id, err)
 			return
 		}
 		responseBody, err = json.Marshal(sharedDir)
@@ -176,40 +194,167 @@ func handleGetSharedDir(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Directories are downloaded as an archive in the format given by query
+// parameter `format`, one of zip, zip-store, tar, tar.gz or tar.zst (zip if
+// empty). Query parameter `inline` set to "true" asks the browser to display the file
+// instead of saving it, e.g. to preview media. Regular files support Range and
+// conditional requests so downloads can be resumed and media can be seeked.
 func handleFileDownload(w http.ResponseWriter, r *http.Request) {
 	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
 
 	path := r.URL.Query().Get("path")
 	rootDirHash := r.URL.Query().Get("root-dir-hash")
+	inline := r.URL.Query().Get("inline") == "true"
 
 	if rootDirHash == "" {
 		http.Error(w, utils.WithId(id, "Invalid path or rootDirHash"), http.StatusBadRequest)
 		return
 	}
 
-	file, fileName, isDir, err := services.GetFileForDownload(path, rootDirHash)
+	info, err := services.GetFileInfo(session, path, rootDirHash)
 	if err != nil {
-		logging.Error.Println(utils.WithId(id, err.Error()))
-		http.Error(w, utils.WithId(id, "Internal error"), http.StatusInternalServerError)
+		writeSharedFileError(w, id, err)
 		return
 	}
 
-	var contentType string
-	if isDir {
-		contentType = "application/zip"
+	if info.IsDir() {
+		format, err := services.ParseArchiveFormat(r.URL.Query().Get("format"))
+		if err != nil {
+			http.Error(w, utils.WithId(id, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.ContentType)
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", info.Name()+format.Extension))
+
+		progress := services.NewDownloadProgress(session, id.String(), info.Name()+format.Extension, -1)
+		err = services.WriteDirectoryArchive(r.Context(), progress.Writer(w), format, session, path, rootDirHash)
+		if err != nil {
+			logging.Error.Println(utils.WithId(id, "Failed to stream directory archive: %v", err))
+			// The status is already sent, abort the connection so the client
+			// doesn't mistake the truncated archive for a complete one
+			panic(http.ErrAbortHandler)
+		}
+		progress.Finish()
+		return
+	}
+
+	file, info, err := services.GetFileForDownload(session, path, rootDirHash)
+	if err != nil {
+		writeSharedFileError(w, id, err)
+		return
+	}
+	defer file.Close()
+
+	if inline {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", info.Name()))
+		// Shared files are not trusted content, don't let them run scripts
+		// on our origin when displayed
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 	} else {
-		contentType = "application/octet-stream"
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", info.Name()))
 	}
+	w.Header().Set("ETag", fileETag(info))
+
+	// Handles Range, If-Range, If-None-Match, If-Modified-Since and friends
+	progress := newProgressResponseWriter(w, services.NewDownloadProgress(session, id.String(), info.Name(), -1))
+	http.ServeContent(progress, r, info.Name(), info.ModTime(), file)
+	progress.finish()
+}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", "attachment; file-name="+fileName)
+// Enough for services.MaxBatchDownloadItems items with long paths
+const MaxBatchDownloadRequestSize = 1 << 20 // 1 MB
+
+type batchDownloadRequest struct {
+	// Archive format, see handleFileDownload
+	Format string                       `json:"format"`
+	Items  []services.BatchDownloadItem `json:"items"`
+}
 
-	// TODO: Check for complete file transfer
-	_, err = io.Copy(w, file)
+// Streams the requested files and directories, possibly from different shared
+// roots, as one archive.
+func handleBatchDownload(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
+
+	var request batchDownloadRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBatchDownloadRequestSize)).Decode(&request)
 	if err != nil {
-		logging.Error.Println(utils.WithId(id, err.Error()))
+		logging.Debug.Println(utils.WithId(id, "Failed to decode request body: %v", err))
+		http.Error(w, utils.WithId(id, "Invalid request body"), http.StatusBadRequest)
 		return
 	}
+	if len(request.Items) > services.MaxBatchDownloadItems {
+		message := fmt.Sprintf("Too many items, at most %d can be downloaded at once", services.MaxBatchDownloadItems)
+		http.Error(w, utils.WithId(id, message), http.StatusBadRequest)
+		return
+	}
+
+	format, err := services.ParseArchiveFormat(request.Format)
+	if err != nil {
+		http.Error(w, utils.WithId(id, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	sources, err := services.ResolveBatchDownload(session, request.Items)
+	if err != nil {
+		writeSharedFileError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "filete-download"+format.Extension))
+
+	progress := services.NewDownloadProgress(session, id.String(), "filete-download"+format.Extension, -1)
+	err = services.WriteBatchArchive(r.Context(), progress.Writer(w), format, sources)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to stream batch archive: %v", err))
+		// See handleFileDownload
+		panic(http.ErrAbortHandler)
+	}
+	progress.Finish()
+}
+
+// Responds with the status matching an error returned when accessing shared
+// files. Errors from the file system are not echoed back as they contain paths
+// on the server.
+func writeSharedFileError(w http.ResponseWriter, id uuid.UUID, err error) {
+	status := http.StatusInternalServerError
+	message := "Internal error"
+	switch {
+	case errors.Is(err, services.ErrInvalidRootDir):
+		status, message = http.StatusNotFound, err.Error()
+	case errors.Is(err, services.ErrPathOutsideRoot), errors.Is(err, services.ErrShareAccessDenied):
+		status, message = http.StatusForbidden, err.Error()
+	case errors.Is(err, services.ErrInvalidPath), errors.Is(err, services.ErrBadBatchRequest):
+		status, message = http.StatusBadRequest, err.Error()
+	case errors.Is(err, services.ErrSymlinkNotAllowed):
+		status, message = http.StatusForbidden, err.Error()
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, services.ErrHiddenFile),
+		errors.Is(err, services.ErrIgnoredFile):
+		status, message = http.StatusNotFound, "File not found"
+	case errors.Is(err, fs.ErrPermission):
+		status, message = http.StatusForbidden, "Permission denied"
+	}
+
+	if status == http.StatusInternalServerError {
+		logging.Error.Println(utils.WithId(id, err.Error()))
+	} else {
+		logging.Debug.Println(utils.WithId(id, err.Error()))
+	}
+	http.Error(w, utils.WithId(id, message), status)
+}
+
+// Strong validator derived from the size and modification time of a file
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+func contentDisposition(disposition, fileName string) string {
+	return mime.FormatMediaType(disposition, map[string]string{"filename": fileName})
 }
 
 // TODO: Get rid of this security vulnerability
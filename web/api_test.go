@@ -0,0 +1,493 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
+	"github.com/sunkit02/filete/services"
+	mw "github.com/sunkit02/filete/web/middleware"
+	"github.com/sunkit02/filete/web/types"
+)
+
+var testKeys = map[services.Role]string{
+	services.RoleAdmin:       "admin-key",
+	services.RoleViewer:      "viewer-key",
+	services.RoleUploader:    "uploader-key",
+	services.RoleContributor: "contributor-key",
+}
+
+func init() {
+	logging.InitializeLoggers(os.Stdout)
+}
+
+// Initializes every service the API routes use and returns the hash of a
+// shared directory holding file.txt
+func initApiTest(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	share := t.TempDir()
+	if err := os.WriteFile(filepath.Join(share, "file.txt"), []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadDir = dir
+	messageRepo = data.NewMemoryMessageRepo()
+
+	err := services.InitDownloadService(services.DownloadServiceConfig{
+		SharedDirectories: []services.SharedDirectoryConfig{{Path: share}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.InitUploadService(services.UploadServiceConfig{UploadDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	err = services.InitIdentityService(services.IdentityServiceConfig{
+		Path: filepath.Join(dir, data.IdentityFileName),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]services.SessionKeyConfig, 0, len(testKeys))
+	for role, key := range testKeys {
+		if role != services.RoleAdmin {
+			keys = append(keys, services.SessionKeyConfig{Key: key, Role: role})
+		}
+	}
+	err = services.InitAuthService(services.AuthServiceConfig{
+		SessionKey: testKeys[services.RoleAdmin],
+		Keys:       keys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots, err := services.ReadRootDirs(services.UserSession{Role: services.RoleAdmin}, 1)
+	if err != nil || len(roots) != 1 {
+		t.Fatalf("Failed to read shared directory: %v", err)
+	}
+	return roots[0].RootDirHash
+}
+
+// Logs in with the key of role
+func login(t *testing.T, role services.Role) services.UserSession {
+	t.Helper()
+
+	session, err := services.AuthenticateWithSessionKey(services.LoginAttempt{
+		ClientIp:   "127.0.0.1",
+		SessionKey: testKeys[role],
+	})
+	if err != nil {
+		t.Fatalf("Failed to log in as %s: %v", role, err)
+	}
+	return *session
+}
+
+// Sends r through the API routes the way StartServer mounts them
+func serveApi(session services.UserSession, r *http.Request) *httptest.ResponseRecorder {
+	r.Header.Set(types.RequestIdHeaderName, uuid.New().String())
+	r.AddCookie(&http.Cookie{Name: types.SessionIdCookieName, Value: session.Id})
+
+	w := httptest.NewRecorder()
+	mw.CookieAuthMiddleware(http.StripPrefix("/api", ApiRoutes())).ServeHTTP(w, r)
+	return w
+}
+
+func newTusRequest(method, target string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", TusVersion)
+	return r
+}
+
+// Creates a completed upload of session attached to a new message
+func createAttachedUpload(t *testing.T, session services.UserSession) (data.Message, services.Upload) {
+	t.Helper()
+
+	upload, err := services.SaveUpload(session, "attachment.txt", 7, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := createMessage(data.Message{
+		Body:        "See attachment",
+		Attachments: []data.Attachment{{UploadId: upload.Id}},
+	}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message, upload
+}
+
+func TestApiRoutePermissions(t *testing.T) {
+	rootDirHash := initApiTest(t)
+
+	var (
+		viewer      = services.RoleViewer
+		uploader    = services.RoleUploader
+		contributor = services.RoleContributor
+		admin       = services.RoleAdmin
+	)
+
+	tests := []struct {
+		name    string
+		allowed []services.Role
+		// Status of allowed requests
+		status int
+		// Builds the request sent by session
+		request func(t *testing.T, session services.UserSession) *http.Request
+	}{
+		{"GET /shared-dir", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/shared-dir", nil)
+			}},
+		{"GET /download", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/download?path=file.txt&root-dir-hash="+rootDirHash, nil)
+			}},
+		{"POST /download/batch", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				body := fmt.Sprintf(`{"format": "zip", "items": [{"rootDirHash": %q, "path": "file.txt"}]}`, rootDirHash)
+				return httptest.NewRequest(http.MethodPost, "/api/download/batch", strings.NewReader(body))
+			}},
+		{"POST /upload", []services.Role{uploader, contributor, admin}, http.StatusCreated,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				var body bytes.Buffer
+				form := multipart.NewWriter(&body)
+				part, err := form.CreateFormFile("file", "upload.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				part.Write([]byte("content"))
+				form.Close()
+
+				r := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+				r.Header.Set("Content-Type", form.FormDataContentType())
+				return r
+			}},
+		{"POST /message", []services.Role{contributor, admin}, http.StatusCreated,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/message", strings.NewReader(`{"body": "Hello"}`))
+			}},
+		{"GET /messages", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+			}},
+		{"GET /messages/{id}", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				message, _ := createAttachedUpload(t, session)
+				return httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/messages/%d", message.Id), nil)
+			}},
+		{"DELETE /messages/{id}", []services.Role{admin}, http.StatusNoContent,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				message, _ := createAttachedUpload(t, session)
+				return httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/messages/%d", message.Id), nil)
+			}},
+		{"GET /messages/{id}/attachments/{uploadId}", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				message, upload := createAttachedUpload(t, session)
+				return httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/messages/%d/attachments/%s", message.Id, upload.Id), nil)
+			}},
+		{"GET /events", []services.Role{viewer, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				// Ends the stream right after the headers are sent
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/events", nil)
+			}},
+		// Without upgrade headers the handshake fails after the permission
+		// check
+		{"GET /ws", []services.Role{viewer, contributor, admin}, http.StatusBadRequest,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/ws", nil)
+			}},
+		{"POST /uploads", []services.Role{uploader, contributor, admin}, http.StatusCreated,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				r := newTusRequest(http.MethodPost, "/api/uploads", "")
+				r.Header.Set("Upload-Length", "7")
+				return r
+			}},
+		{"HEAD /uploads/{id}", []services.Role{uploader, contributor, admin}, http.StatusOK,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				upload, err := services.CreateUpload(session, 7, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return newTusRequest(http.MethodHead, "/api/uploads/"+upload.Id, "")
+			}},
+		{"PATCH /uploads/{id}", []services.Role{uploader, contributor, admin}, http.StatusNoContent,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				upload, err := services.CreateUpload(session, 7, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := newTusRequest(http.MethodPatch, "/api/uploads/"+upload.Id, "content")
+				r.Header.Set("Content-Type", TusChunkMediaType)
+				r.Header.Set("Upload-Offset", "0")
+				return r
+			}},
+		{"DELETE /uploads/{id}", []services.Role{uploader, contributor, admin}, http.StatusNoContent,
+			func(t *testing.T, session services.UserSession) *http.Request {
+				upload, err := services.CreateUpload(session, 7, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return newTusRequest(http.MethodDelete, "/api/uploads/"+upload.Id, "")
+			}},
+	}
+
+	for _, test := range tests {
+		for _, role := range []services.Role{viewer, uploader, contributor, admin} {
+			session := login(t, role)
+			w := serveApi(session, test.request(t, session))
+
+			expected := http.StatusForbidden
+			if slices.Contains(test.allowed, role) {
+				expected = test.status
+			}
+			if w.Code != expected {
+				t.Fatalf("%s as %s: expected status %d. Got %d: %s", test.name, role, expected, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+func TestWebSocketSendMessagePermission(t *testing.T) {
+	initApiTest(t)
+
+	frame := wsFrame{Type: WsSendMessage, Data: json.RawMessage(`{"body": "Hello"}`)}
+	for role, allowed := range map[services.Role]bool{
+		services.RoleViewer:      false,
+		services.RoleUploader:    false,
+		services.RoleContributor: true,
+		services.RoleAdmin:       true,
+	} {
+		reply := handleWebSocketFrame(frame, login(t, role), uuid.New())
+
+		expected := WsError
+		if allowed {
+			expected = WsMessageSent
+		}
+		if reply.Type != expected {
+			t.Fatalf("send-message as %s: expected reply %s. Got %+v", role, expected, reply)
+		}
+	}
+}
+
+func TestManageUploadsOfOtherSessions(t *testing.T) {
+	initApiTest(t)
+
+	owner := login(t, services.RoleContributor)
+	other := login(t, services.RoleContributor)
+	admin := login(t, services.RoleAdmin)
+
+	upload, err := services.CreateUpload(owner, 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/uploads/" + upload.Id
+
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+		r := newTusRequest(method, target, "content")
+		r.Header.Set("Content-Type", TusChunkMediaType)
+		r.Header.Set("Upload-Offset", "0")
+		if w := serveApi(other, r); w.Code != http.StatusForbidden {
+			t.Fatalf("%s of another session's upload: expected status 403. Got %d", method, w.Code)
+		}
+	}
+	if w := serveApi(admin, newTusRequest(http.MethodHead, target, "")); w.Code != http.StatusOK {
+		t.Fatalf("Expected admins to see every upload. Got %d", w.Code)
+	}
+
+	// Uploads can only be attached by their owner
+	completed, err := services.SaveUpload(owner, "attachment.txt", 7, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"body": "Mine", "attachments": [{"uploadId": %q}]}`, completed.Id)
+	if w := serveApi(other, httptest.NewRequest(http.MethodPost, "/api/message", strings.NewReader(body))); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected attaching another session's upload to fail. Got %d", w.Code)
+	}
+	if w := serveApi(owner, httptest.NewRequest(http.MethodPost, "/api/message", strings.NewReader(body))); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the owner to attach the upload. Got %d: %s", w.Code, w.Body)
+	}
+
+	// The message would lose its attachment
+	w := serveApi(owner, newTusRequest(http.MethodDelete, "/api/uploads/"+completed.Id, ""))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected deleting an attached upload to conflict. Got %d", w.Code)
+	}
+}
+
+func TestCreateUploadWithFirstChunk(t *testing.T) {
+	initApiTest(t)
+	session := login(t, services.RoleUploader)
+
+	tests := []struct {
+		body   string
+		status int
+		offset string
+	}{
+		{"content", http.StatusCreated, "7"},
+		{"cont", http.StatusCreated, "4"},
+		// Only the declared bytes are kept
+		{"content and more", http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for _, test := range tests {
+		r := newTusRequest(http.MethodPost, "/api/uploads", test.body)
+		r.Header.Set("Upload-Length", "7")
+		r.Header.Set("Content-Type", TusChunkMediaType)
+
+		w := serveApi(session, r)
+		if w.Code != test.status {
+			t.Fatalf("Sending %q: expected status %d. Got %d: %s", test.body, test.status, w.Code, w.Body)
+		}
+		if offset := w.Header().Get("Upload-Offset"); offset != test.offset {
+			t.Fatalf("Sending %q: expected Upload-Offset %q. Got %q", test.body, test.offset, offset)
+		}
+	}
+}
+
+func TestDownloadRangesAndConditions(t *testing.T) {
+	rootDirHash := initApiTest(t)
+	session := login(t, services.RoleViewer)
+	target := "/api/download?path=file.txt&root-dir-hash=" + rootDirHash
+
+	w := serveApi(session, httptest.NewRequest(http.MethodGet, target, nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "content" || etag == "" {
+		t.Fatalf("Expected the file with an ETag. Got %d %q: %s", w.Code, etag, w.Body)
+	}
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"range", map[string]string{"Range": "bytes=0-2"}, http.StatusPartialContent, "con", "bytes 0-2/7"},
+		{"open range", map[string]string{"Range": "bytes=3-"}, http.StatusPartialContent, "tent", "bytes 3-6/7"},
+		{"matching If-Range", map[string]string{"Range": "bytes=3-", "If-Range": etag}, http.StatusPartialContent, "tent", "bytes 3-6/7"},
+		{"stale If-Range", map[string]string{"Range": "bytes=3-", "If-Range": `"stale"`}, http.StatusOK, "content", ""},
+		{"matching If-None-Match", map[string]string{"If-None-Match": etag}, http.StatusNotModified, "", ""},
+		{"stale If-None-Match", map[string]string{"If-None-Match": `"stale"`}, http.StatusOK, "content", ""},
+		{"unsatisfiable range", map[string]string{"Range": "bytes=10-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */7"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+
+		w := serveApi(session, r)
+		if w.Code != test.status {
+			t.Fatalf("%s: expected status %d. Got %d: %s", test.name, test.status, w.Code, w.Body)
+		}
+		if test.status != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != test.body {
+			t.Fatalf("%s: expected %q. Got %q", test.name, test.body, w.Body)
+		}
+		if contentRange := w.Header().Get("Content-Range"); contentRange != test.contentRange {
+			t.Fatalf("%s: expected Content-Range %q. Got %q", test.name, test.contentRange, contentRange)
+		}
+	}
+}
+
+func TestBatchDownloadRejectsOversizedRequests(t *testing.T) {
+	rootDirHash := initApiTest(t)
+	session := login(t, services.RoleViewer)
+
+	item := fmt.Sprintf(`{"rootDirHash": %q, "path": "file.txt"}`, rootDirHash)
+	items := strings.Repeat(item+",", services.MaxBatchDownloadItems) + item
+	padding := strings.Repeat(" ", MaxBatchDownloadRequestSize)
+
+	for name, body := range map[string]string{
+		"too many items":    `{"format": "zip", "items": [` + items + `]}`,
+		"too large request": `{"format": "zip",` + padding + `"items": [` + item + `]}`,
+	} {
+		w := serveApi(session, httptest.NewRequest(http.MethodPost, "/api/download/batch", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d. Got %d: %s", name, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+}
+
+// Logs in through POST /auth/authenticate and returns the session of the
+// cookie set in the response
+func loginOverHttp(t *testing.T, body string) services.UserSession {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/auth/authenticate", strings.NewReader(body))
+	r.Header.Set(types.RequestIdHeaderName, uuid.New().String())
+	w := httptest.NewRecorder()
+	http.StripPrefix("/auth", AuthRoutes()).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to log in with %s: %d %s", body, w.Code, w.Body)
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if session, ok := services.ValidateSessionCookie(*cookie); ok {
+			return session
+		}
+	}
+	t.Fatalf("Expected a session cookie. Got %v", w.Result().Cookies())
+	return services.UserSession{}
+}
+
+func TestSelfRegisteredAliasCantAccessRestrictedShare(t *testing.T) {
+	initApiTest(t)
+
+	hash, err := services.HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = services.InitIdentityService(services.IdentityServiceConfig{
+		Path:       filepath.Join(t.TempDir(), data.IdentityFileName),
+		Identities: []data.Identity{{Alias: "alice", Secret: hash}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private := t.TempDir()
+	if err := os.WriteFile(filepath.Join(private, "file.txt"), []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = services.InitDownloadService(services.DownloadServiceConfig{
+		SharedDirectories: []services.SharedDirectoryConfig{{Path: private, AllowedAliases: []string{"alice", "bob"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := services.ReadRootDirs(services.UserSession{Role: services.RoleAdmin}, 1)
+	if err != nil || len(roots) != 1 {
+		t.Fatalf("Failed to read shared directory: %v", err)
+	}
+	target := "/api/download?path=file.txt&root-dir-hash=" + roots[0].RootDirHash
+
+	// bob is allowed but not configured, so anyone can register it
+	bob := loginOverHttp(t, `{"sessionKey": "viewer-key", "alias": "bob", "secret": "mine now"}`)
+	if w := serveApi(bob, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d for a self-registered alias. Got %d: %s", http.StatusForbidden, w.Code, w.Body)
+	}
+
+	alice := loginOverHttp(t, `{"sessionKey": "viewer-key", "alias": "alice", "secret": "secret"}`)
+	if w := serveApi(alice, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for a configured identity. Got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+}
@@ -2,8 +2,13 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sunkit02/filete/logging"
 	"github.com/sunkit02/filete/services"
@@ -22,6 +27,15 @@ func AuthRoutes() *http.ServeMux {
 
 type authRequest struct {
 	SessionKey string `json:"sessionKey"`
+	// Alias to send messages as. A guest alias is generated if empty.
+	Alias string `json:"alias"`
+	// Registers the alias if it is free, or claims it if it is registered
+	Secret string `json:"secret"`
+}
+
+type authResponse struct {
+	Alias string        `json:"alias"`
+	Role  services.Role `json:"role"`
 }
 
 func handleAuthenticate(w http.ResponseWriter, r *http.Request) {
@@ -45,13 +59,37 @@ func handleAuthenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logging.Trace.Println("authRequest", authReq)
+	logging.Trace.Println("authRequest alias", authReq.Alias)
 
-	session, err := services.AuthenticateWithSessionKey(authReq.SessionKey)
+	session, err := services.AuthenticateWithSessionKey(services.LoginAttempt{
+		ClientIp:   clientIp(r),
+		SessionKey: authReq.SessionKey,
+		Alias:      authReq.Alias,
+		Secret:     authReq.Secret,
+	})
 	if err != nil {
-		msg := utils.WithId(id, "Invalid sessionId")
-		logging.Debug.Println(msg, http.StatusUnauthorized)
-		http.Error(w, msg, http.StatusUnauthorized)
+		status := http.StatusInternalServerError
+		msg := err.Error()
+		var tooMany *services.TooManyAttemptsError
+		switch {
+		case errors.As(err, &tooMany):
+			status = http.StatusTooManyRequests
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(tooMany.RetryAfter.Seconds()))))
+		case errors.Is(err, services.ErrInvalidSessionKey):
+			status, msg = http.StatusUnauthorized, "Invalid sessionId"
+		case errors.Is(err, services.ErrInvalidAlias), errors.Is(err, services.ErrInvalidSecret):
+			status = http.StatusBadRequest
+		case errors.Is(err, services.ErrAliasTaken):
+			status = http.StatusConflict
+		case errors.Is(err, services.ErrWrongSecret):
+			status = http.StatusForbidden
+		default:
+			logging.Error.Println(utils.WithId(id, "Failed to claim identity: %v", err))
+			msg = "Failed to authenticate"
+		}
+
+		logging.Debug.Println(utils.WithId(id, msg), status)
+		http.Error(w, utils.WithId(id, msg), status)
 		return
 	}
 
@@ -61,10 +99,21 @@ func handleAuthenticate(w http.ResponseWriter, r *http.Request) {
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   true,
-		MaxAge:   3600, // one hour
+		// Expires with the session
+		MaxAge: int(time.Until(session.Expires).Round(time.Second).Seconds()),
 	})
 
-	w.WriteHeader(http.StatusNoContent)
+	writeJSON(w, id, http.StatusOK, authResponse{Alias: session.Alias, Role: session.Role})
+}
+
+// Returns the address of the client without the port. Forwarding headers are
+// ignored as they can be set by anyone.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func handleInvalidateToken(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web/types"
+)
+
+func TestSessionCookieLastsAsLongAsTheSession(t *testing.T) {
+	initApiTest(t)
+	err := services.InitAuthService(services.AuthServiceConfig{
+		SessionKey:    testKeys[services.RoleAdmin],
+		SessionLength: 8 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/auth/authenticate", strings.NewReader(`{"sessionKey": "admin-key"}`))
+	r.Header.Set(types.RequestIdHeaderName, uuid.New().String())
+	w := httptest.NewRecorder()
+	http.StripPrefix("/auth", AuthRoutes()).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d. Got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != types.SessionIdCookieName {
+		t.Fatalf("Expected a session cookie. Got %v", cookies)
+	}
+	if maxAge := time.Duration(cookies[0].MaxAge) * time.Second; maxAge != 8*time.Hour {
+		t.Fatalf("Expected the cookie to last 8h. Got %s", maxAge)
+	}
+}
@@ -0,0 +1,164 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web/middleware"
+	"github.com/sunkit02/filete/web/utils"
+)
+
+// Server-Sent Events stream of everything published through services.PublishEvent.
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html
+
+// Interval of the comments sent to keep idle connections from timing out
+const EventsHeartbeatInterval = 30 * time.Second
+
+func registerEventRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /events", requires(services.PermissionReadMessages, http.HandlerFunc(handleEvents)))
+}
+
+// Streams events until the client disconnects. message-created events carry
+// the message id as event id, so a reconnecting client sending Last-Event-ID
+// (or query parameter `last-event-id` on the first connection) first receives
+// every message it missed.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
+
+	replayAfter, replay, err := parseLastEventId(r)
+	if err != nil {
+		http.Error(w, utils.WithId(id, "Invalid Last-Event-ID"), http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before replaying so no message created in between is lost
+	events, unsubscribe := services.SubscribeEvents(session)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+
+	if replay {
+		replayAfter, err = replayMessages(replayAfter, func(event services.Event) error {
+			return writeEvent(w, event)
+		})
+		if err != nil {
+			logging.Error.Println(utils.WithId(id, "Failed to replay messages: %v", err))
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		logging.Error.Println(utils.WithId(id, "Event stream can't be flushed: %v", err))
+		return
+	}
+
+	heartbeat := time.NewTicker(EventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// Fell behind, the client reconnects and catches up with
+				// Last-Event-ID
+				logging.Debug.Println(utils.WithId(id, "Event subscriber dropped"))
+				return
+			}
+			if isReplayed(event, replayAfter) {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				logging.Debug.Println(utils.WithId(id, "Failed to write event: %v", err))
+				return
+			}
+		}
+
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Returns the id of the last message seen by a client, taken from the
+// Last-Event-ID header or query parameter `last-event-id`, and whether it was
+// given
+func parseLastEventId(r *http.Request) (data.MessageId, bool, error) {
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last-event-id")
+	}
+	if lastEventId == "" {
+		return 0, false, nil
+	}
+
+	parsed, err := strconv.ParseUint(lastEventId, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return data.MessageId(parsed), true, nil
+}
+
+// Sends a message-created event for every message after the given id and
+// returns the id of the last one sent. Events of the same messages received
+// from a subscription made before replaying are filtered with isReplayed.
+func replayMessages(after data.MessageId, send func(services.Event) error) (data.MessageId, error) {
+	messages, err := messageRepo.Query(data.MessageQuery{AfterId: after})
+	if err != nil {
+		return after, err
+	}
+
+	for _, message := range messages {
+		if err := send(messageCreatedEvent(message)); err != nil {
+			return after, err
+		}
+		after = message.Id
+	}
+
+	return after, nil
+}
+
+func isReplayed(event services.Event, replayedUpTo data.MessageId) bool {
+	message, isMessage := event.Data.(data.Message)
+	return isMessage && message.Id <= replayedUpTo
+}
+
+func messageCreatedEvent(message data.Message) services.Event {
+	return services.Event{
+		Id:   strconv.FormatUint(uint64(message.Id), 10),
+		Type: services.EventMessageCreated,
+		Data: message,
+	}
+}
+
+func writeEvent(w io.Writer, event services.Event) error {
+	payload, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	if event.Id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.Id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, payload)
+	return err
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/services"
+	mw "github.com/sunkit02/filete/web/middleware"
+	"github.com/sunkit02/filete/web/types"
+)
+
+// Connects to the event stream of server, sending lastEventId if not empty.
+// Returns the ids of message-created events in the order received and a
+// function closing the connection.
+func streamMessageIds(t *testing.T, server *httptest.Server, session services.UserSession, lastEventId string) (<-chan string, func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: types.SessionIdCookieName, Value: session.Id})
+	if lastEventId != "" {
+		r.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	response, err := server.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d. Got %d", http.StatusOK, response.StatusCode)
+	}
+
+	ids := make(chan string, 100)
+	go func() {
+		defer close(ids)
+		defer response.Body.Close()
+
+		var id, eventType string
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case line == "":
+				if eventType == services.EventMessageCreated {
+					ids <- id
+				}
+				id, eventType = "", ""
+			}
+		}
+	}()
+
+	return ids, cancel
+}
+
+// Receives message ids from ids until last arrives
+func receiveMessageIdsUntil(t *testing.T, ids <-chan string, last data.MessageId) []string {
+	t.Helper()
+
+	var received []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case id, ok := <-ids:
+			if !ok {
+				t.Fatalf("Stream closed after %v", received)
+			}
+			received = append(received, id)
+			if id == fmt.Sprint(last) {
+				return received
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for message %d. Got %v", last, received)
+		}
+	}
+}
+
+func TestEventsReplayMissedMessagesOnce(t *testing.T) {
+	initApiTest(t)
+	session := login(t, services.RoleContributor)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(types.RequestIdHeaderName, uuid.New().String())
+		mw.CookieAuthMiddleware(http.StripPrefix("/api", ApiRoutes())).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	send := func(body string) data.MessageId {
+		t.Helper()
+		message, err := createMessage(data.Message{Body: body}, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message.Id
+	}
+
+	ids, disconnect := streamMessageIds(t, server, session, "")
+	first := send("received")
+	received := receiveMessageIdsUntil(t, ids, first)
+	disconnect()
+	lastEventId := received[len(received)-1]
+
+	var expected []string
+	for _, body := range []string{"missed", "also missed"} {
+		expected = append(expected, fmt.Sprint(send(body)))
+	}
+
+	ids, disconnect = streamMessageIds(t, server, session, lastEventId)
+	defer disconnect()
+	// Created while the missed messages may still be replayed
+	for _, body := range []string{"live", "also live"} {
+		expected = append(expected, fmt.Sprint(send(body)))
+	}
+
+	last := send("last")
+	expected = append(expected, fmt.Sprint(last))
+
+	received = receiveMessageIdsUntil(t, ids, last)
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Fatalf("Expected messages %v exactly once. Got %v", expected, received)
+	}
+}
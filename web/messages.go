@@ -0,0 +1,264 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web/middleware"
+	"github.com/sunkit02/filete/web/utils"
+)
+
+const (
+	DefaultMessagesLimit = 50
+	MaxMessagesLimit     = 500
+)
+
+func registerMessageRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /messages", requires(services.PermissionReadMessages, http.HandlerFunc(handleGetMessages)))
+	mux.Handle("GET /messages/{id}", requires(services.PermissionReadMessages, http.HandlerFunc(handleGetMessage)))
+	mux.Handle("DELETE /messages/{id}", requires(services.PermissionManageMessages, http.HandlerFunc(handleDeleteMessage)))
+	mux.Handle("GET /messages/{id}/attachments/{uploadId}", requires(services.PermissionReadMessages, http.HandlerFunc(handleGetAttachment)))
+}
+
+// Returns up to `limit` messages ordered by id, starting after the message
+// with id `after-id`. The id of the last message returned is the `after-id`
+// of the next page. Messages can be filtered with `q` (every word has to
+// appear in the body), `sender` and the RFC 3339 times `since` and `until`.
+func handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+	params := r.URL.Query()
+
+	query := data.MessageQuery{
+		Limit:  DefaultMessagesLimit,
+		Text:   params.Get("q"),
+		Sender: params.Get("sender"),
+	}
+
+	if s := params.Get("after-id"); s != "" {
+		parsed, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, utils.WithId(id, "Invalid after-id"), http.StatusBadRequest)
+			return
+		}
+		query.AfterId = data.MessageId(parsed)
+	}
+
+	if s := params.Get("limit"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil || parsed < 1 || parsed > MaxMessagesLimit {
+			http.Error(w, utils.WithId(id, "limit must be between 1 and %d", MaxMessagesLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = parsed
+	}
+
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if s := params.Get(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, utils.WithId(id, "Invalid %s. Must be an RFC 3339 time", name), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	messages, err := messageRepo.Query(query)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to read messages: %v", err))
+		http.Error(w, utils.WithId(id, "Failed to read messages"), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, id, http.StatusOK, messages)
+}
+
+func handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+
+	messageId, ok := parseMessageId(w, r, id)
+	if !ok {
+		return
+	}
+
+	message, exists, err := messageRepo.Get(messageId)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to read message %d: %v", messageId, err))
+		http.Error(w, utils.WithId(id, "Failed to read message"), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, utils.WithId(id, "Message not found"), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, id, http.StatusOK, message)
+}
+
+func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+
+	messageId, ok := parseMessageId(w, r, id)
+	if !ok {
+		return
+	}
+
+	_, exists, err := messageRepo.Get(messageId)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to read message %d: %v", messageId, err))
+		http.Error(w, utils.WithId(id, "Failed to delete message"), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, utils.WithId(id, "Message not found"), http.StatusNotFound)
+		return
+	}
+
+	if err := messageRepo.Delete(messageId); err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to delete message %d: %v", messageId, err))
+		http.Error(w, utils.WithId(id, "Failed to delete message"), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Downloads a file attached to the message. Only uploads the message
+// references can be downloaded this way.
+func handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
+
+	messageId, ok := parseMessageId(w, r, id)
+	if !ok {
+		return
+	}
+
+	message, exists, err := messageRepo.Get(messageId)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to read message %d: %v", messageId, err))
+		http.Error(w, utils.WithId(id, "Failed to read message"), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, utils.WithId(id, "Message not found"), http.StatusNotFound)
+		return
+	}
+
+	uploadId := r.PathValue("uploadId")
+	if !slices.ContainsFunc(message.Attachments, func(a data.Attachment) bool { return a.UploadId == uploadId }) {
+		http.Error(w, utils.WithId(id, "Attachment not found"), http.StatusNotFound)
+		return
+	}
+
+	file, upload, err := services.OpenUpload(uploadId)
+	if errors.Is(err, services.ErrUploadNotFound) {
+		http.Error(w, utils.WithId(id, "Attachment is no longer available"), http.StatusGone)
+		return
+	} else if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to open attachment %s: %v", uploadId, err))
+		http.Error(w, utils.WithId(id, "Failed to read attachment"), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to stat attachment %s: %v", uploadId, err))
+		http.Error(w, utils.WithId(id, "Failed to read attachment"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", upload.FileName))
+	w.Header().Set("ETag", fileETag(info))
+
+	// See handleFileDownload
+	progress := newProgressResponseWriter(w, services.NewDownloadProgress(session, id.String(), upload.FileName, -1))
+	http.ServeContent(progress, r, upload.FileName, info.ModTime(), file)
+	progress.finish()
+}
+
+// Stores a new message sent by the session's identity and publishes it to
+// connected clients. Attachments must reference completed uploads of the
+// session, otherwise an error matched by isAttachmentError is returned.
+func createMessage(message data.Message, session services.UserSession) (data.Message, error) {
+	// Ids are assigned by the repository
+	message.Id = 0
+	message.Sender = session.Alias
+	if message.TimeSent.IsZero() {
+		message.TimeSent = time.Now().UTC()
+	}
+
+	attachments, err := services.ResolveAttachments(session, message.Attachments)
+	if err != nil {
+		return data.Message{}, err
+	}
+	message.Attachments = attachments
+
+	message, err = messageRepo.Add(message)
+	if err != nil {
+		return data.Message{}, err
+	}
+
+	services.PublishEvent(messageCreatedEvent(message))
+	return message, nil
+}
+
+// Reports whether createMessage failed because of the attachments the client
+// sent
+func isAttachmentError(err error) bool {
+	return errors.Is(err, services.ErrUploadNotFound) ||
+		errors.Is(err, services.ErrUploadIncomplete) ||
+		errors.Is(err, services.ErrUploadNotOwned) ||
+		errors.Is(err, services.ErrTooManyAttachments)
+}
+
+// Reports whether a message references the upload as attachment
+func isUploadAttached(uploadId string) (bool, error) {
+	messages, err := messageRepo.GetAll()
+	if err != nil {
+		return false, err
+	}
+
+	for _, message := range messages {
+		if slices.ContainsFunc(message.Attachments, func(a data.Attachment) bool { return a.UploadId == uploadId }) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Parses the `id` path value, writing a 400 response and returning false if
+// it is invalid
+func parseMessageId(w http.ResponseWriter, r *http.Request, id uuid.UUID) (data.MessageId, bool) {
+	messageId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, utils.WithId(id, "Invalid message id"), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return data.MessageId(messageId), true
+}
+
+func writeJSON(w http.ResponseWriter, id uuid.UUID, status int, v any) {
+	responseBody, err := json.Marshal(v)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, err.Error()))
+		http.Error(w, utils.WithId(id, "Internal error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(responseBody); err != nil {
+		logging.Error.Println(utils.WithId(id, err.Error()))
+	}
+}
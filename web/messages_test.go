@@ -0,0 +1,115 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/services"
+)
+
+// Sends a GET request for target and decodes the messages it responds with
+func getMessages(t *testing.T, session services.UserSession, target string) []data.Message {
+	t.Helper()
+
+	w := serveApi(session, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected status %d. Got %d: %s", target, http.StatusOK, w.Code, w.Body)
+	}
+	var messages []data.Message
+	if err := json.NewDecoder(w.Body).Decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func messageIds(messages []data.Message) []data.MessageId {
+	ids := make([]data.MessageId, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+	return ids
+}
+
+func TestGetMessagesPaging(t *testing.T) {
+	initApiTest(t)
+	session := login(t, services.RoleViewer)
+
+	count := MaxMessagesLimit + 10
+	for i := 0; i < count; i++ {
+		if _, err := createMessage(data.Message{Body: fmt.Sprint(i)}, session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if messages := getMessages(t, session, "/api/messages"); len(messages) != DefaultMessagesLimit || messages[0].Id != 1 {
+		t.Fatalf("Expected the first %d messages. Got %v", DefaultMessagesLimit, messageIds(messages))
+	}
+	if messages := getMessages(t, session, fmt.Sprintf("/api/messages?limit=%d", MaxMessagesLimit)); len(messages) != MaxMessagesLimit {
+		t.Fatalf("Expected %d messages. Got %d", MaxMessagesLimit, len(messages))
+	}
+
+	pages := map[string][]data.MessageId{
+		"/api/messages?limit=2":                               {1, 2},
+		"/api/messages?after-id=2&limit=2":                    {3, 4},
+		fmt.Sprintf("/api/messages?after-id=%d", count-1):     {data.MessageId(count)},
+		fmt.Sprintf("/api/messages?after-id=%d", count):       {},
+		fmt.Sprintf("/api/messages?after-id=%d", count+1_000): {},
+	}
+	for target, expected := range pages {
+		ids := messageIds(getMessages(t, session, target))
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Fatalf("GET %s: expected messages %v. Got %v", target, expected, ids)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", fmt.Sprintf("limit=%d", MaxMessagesLimit+1), "limit=many", "after-id=-1", "after-id=last"} {
+		w := serveApi(session, httptest.NewRequest(http.MethodGet, "/api/messages?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d. Got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestGetAndDeleteMessage(t *testing.T) {
+	initApiTest(t)
+	admin := login(t, services.RoleAdmin)
+
+	message, err := createMessage(data.Message{Body: "Hello"}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/messages/%d", message.Id)
+
+	w := serveApi(admin, httptest.NewRequest(http.MethodGet, target, nil))
+	var got data.Message
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&got) != nil || got.Body != "Hello" {
+		t.Fatalf("Expected the message. Got %d: %+v", w.Code, got)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/api/messages/999", http.StatusNotFound},
+		{http.MethodGet, "/api/messages/first", http.StatusBadRequest},
+		{http.MethodDelete, "/api/messages/999", http.StatusNotFound},
+		{http.MethodDelete, target, http.StatusNoContent},
+		{http.MethodGet, target, http.StatusNotFound},
+		{http.MethodDelete, target, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := serveApi(admin, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.status {
+			t.Fatalf("%s %s: expected status %d. Got %d: %s", test.method, test.target, test.status, w.Code, w.Body)
+		}
+	}
+
+	if messages := getMessages(t, admin, "/api/messages"); len(messages) != 0 {
+		t.Fatalf("Expected the message to be gone. Got %+v", messages)
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/sunkit02/filete/logging"
@@ -21,12 +22,22 @@ func CookieAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		if !services.ValidateSessionCookie(*authCookie) {
+		session, ok := services.ValidateSessionCookie(*authCookie)
+		if !ok {
 			logging.Debug.Println(utils.WithId(id, "CookieAuthMiddleware: invalid cookie"))
 			http.Error(w, utils.WithId(id, "Invalid auth cookie"), http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
 	})
 }
+
+type sessionContextKey struct{}
+
+// Returns the session CookieAuthMiddleware authenticated the request with and
+// false if the request didn't pass through it
+func ExtractSession(r *http.Request) (services.UserSession, bool) {
+	session, ok := r.Context().Value(sessionContextKey{}).(services.UserSession)
+	return session, ok
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/sunkit02/filete/logging"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web/utils"
+)
+
+// Rejects requests whose session lacks permission. Must be behind
+// CookieAuthMiddleware.
+func PermissionMiddleware(permission services.Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ExtractRequestId(r)
+
+		session, ok := ExtractSession(r)
+		if !ok || !session.Role.Can(permission) {
+			logging.Debug.Println(utils.WithId(id, "PermissionMiddleware: role '%s' lacks permission %s", session.Role, permission))
+			http.Error(w, utils.WithId(id, "Not allowed"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/sunkit02/filete/services"
+)
+
+// Bytes passed on per call to the wrapped ReadFrom, so progress is reported
+// while large files are sent
+const progressChunkSize = 1 << 20
+
+// Records the bytes of a successful response actually written to the client,
+// with its Content-Length as total. Unlike counting the reads of the file,
+// this ignores the reads http.ServeContent uses to sniff the content type and
+// keeps the file visible to the connection, which sends it with sendfile.
+type progressResponseWriter struct {
+	http.ResponseWriter
+	tracker     *services.ProgressTracker
+	wroteHeader bool
+	// Whether the response is a file download worth reporting, not e.g. a
+	// 304 or 416
+	tracked bool
+}
+
+func newProgressResponseWriter(w http.ResponseWriter, tracker *services.ProgressTracker) *progressResponseWriter {
+	return &progressResponseWriter{ResponseWriter: w, tracker: tracker}
+}
+
+func (w *progressResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.tracked = status == http.StatusOK || status == http.StatusPartialContent
+		if total, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			w.tracker.SetTotal(total)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *progressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if w.tracked {
+		w.tracker.Add(int64(n))
+	}
+	return n, err
+}
+
+// Used by io.Copy in http.ServeContent. The file is passed on in chunks, as
+// *io.LimitedReader of the file itself, which still allows sendfile.
+func (w *progressResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	remaining := int64(math.MaxInt64)
+	if limited, ok := src.(*io.LimitedReader); ok {
+		src, remaining = limited.R, limited.N
+		defer func() { limited.N = remaining }()
+	}
+
+	var written int64
+	for remaining > 0 {
+		chunk := min(remaining, progressChunkSize)
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		written += n
+		remaining -= n
+		if w.tracked {
+			w.tracker.Add(n)
+		}
+		if err != nil || n < chunk {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *progressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Publishes the final progress if a file was sent
+func (w *progressResponseWriter) finish() {
+	if w.tracked {
+		w.tracker.Finish()
+	}
+}
@@ -0,0 +1,92 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunkit02/filete/services"
+)
+
+func TestDownloadProgressCountsWrittenBytes(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), progressChunkSize/4)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	session := services.UserSession{Id: "downloader"}
+	served := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { served <- struct{}{} }()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("ETag", `"etag"`)
+		progress := newProgressResponseWriter(w, services.NewDownloadProgress(session, "id", "file", -1))
+		http.ServeContent(progress, r, "file", time.Time{}, file)
+		progress.finish()
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		header string
+		value  string
+		// Expected bytes, 0 for no progress events
+		size int64
+	}{
+		{"", "", int64(len(content))},
+		{"Range", "bytes=2-4", 3},
+		{"Range", "bytes=10-", int64(len(content)) - 10},
+		{"If-None-Match", `"etag"`, 0},
+		{"Range", "bytes=99999999-", 0},
+	}
+
+	for _, test := range tests {
+		events, unsubscribe := services.SubscribeEvents(session)
+
+		r, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-served
+		unsubscribe()
+
+		var last *services.TransferProgress
+		for event := range events {
+			progress := event.Data.(services.TransferProgress)
+			last = &progress
+		}
+
+		if test.size == 0 {
+			if last != nil {
+				t.Fatalf("%s %s: expected no progress events. Got %+v", test.header, test.value, *last)
+			}
+			continue
+		}
+		if int64(len(body)) != test.size {
+			t.Fatalf("%s %s: expected %d bytes. Got %d", test.header, test.value, test.size, len(body))
+		}
+		if last == nil || !last.Done || last.Transferred != test.size || last.Total != test.size {
+			t.Fatalf("%s %s: expected a final event with %d of %d bytes. Got %+v", test.header, test.value, test.size, test.size, last)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sunkit02/filete/logging"
+)
+
+const (
+	SelfSignedCertFileName = "self-signed.crt"
+	SelfSignedKeyFileName  = "self-signed.key"
+
+	selfSignedCertLifetime = 365 * 24 * time.Hour
+	// Cached certificates expiring sooner than this are regenerated
+	selfSignedCertMinRemaining = 24 * time.Hour
+)
+
+// Loads the TLS certificate to serve with. Generates a self-signed one when
+// configs.SelfSigned is set, otherwise reads configs.CertFile and configs.KeyFile.
+func loadCertificate(configs ServerConfigs) (tls.Certificate, error) {
+	if !configs.SelfSigned {
+		return tls.LoadX509KeyPair(configs.CertFile, configs.KeyFile)
+	}
+
+	hosts, ips := localHostsAndIps()
+
+	if configs.CertCacheDir != "" {
+		cert, err := loadCachedCertificate(configs.CertCacheDir, hosts, ips)
+		if err == nil {
+			logging.Info.Println("Using cached self-signed certificate from", configs.CertCacheDir)
+			return cert, nil
+		}
+		logging.Info.Println("Generating new self-signed certificate:", err)
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCertificate(hosts, ips)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if configs.CertCacheDir != "" {
+		err := persistCertificate(configs.CertCacheDir, certPEM, keyPEM)
+		if err != nil {
+			// Still usable for this run, the next start just generates a new one
+			logging.Warning.Println("Failed to cache self-signed certificate:", err)
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Returns the SHA-256 fingerprint of the leaf certificate formatted as
+// colon separated hex pairs, the same way browsers display it.
+func certificateFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	pairs := make([]string, len(sum))
+	for i, b := range sum {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
+
+// Generates a PEM encoded ECDSA P-256 certificate and key valid for the given
+// host names and IP addresses.
+func generateSelfSignedCertificate(hosts []string, ips []net.IP) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"filete"},
+			CommonName:   hosts[0],
+		},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(selfSignedCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              hosts,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// Loads a previously generated certificate from dir. Returns an error if it
+// doesn't exist, is about to expire or doesn't cover all current hosts and IPs,
+// e.g. because the machine joined a different network.
+func loadCachedCertificate(dir string, hosts []string, ips []net.IP) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(dir, SelfSignedCertFileName),
+		filepath.Join(dir, SelfSignedKeyFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return tls.Certificate{}, errors.New("no cached certificate")
+	} else if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	if time.Until(leaf.NotAfter) < selfSignedCertMinRemaining {
+		return tls.Certificate{}, errors.New("cached certificate is about to expire")
+	}
+
+	for _, host := range hosts {
+		if !slices.Contains(leaf.DNSNames, host) {
+			return tls.Certificate{}, fmt.Errorf("cached certificate doesn't cover host %s", host)
+		}
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(leaf.IPAddresses, ip.Equal) {
+			return tls.Certificate{}, fmt.Errorf("cached certificate doesn't cover IP %s", ip)
+		}
+	}
+
+	return cert, nil
+}
+
+func persistCertificate(dir string, certPEM, keyPEM []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	err := os.WriteFile(filepath.Join(dir, SelfSignedKeyFileName), keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, SelfSignedCertFileName), certPEM, 0644)
+}
+
+// Returns the host names and IP addresses clients may use to reach this
+// machine. Always includes localhost and the loopback addresses.
+func localHostsAndIps() ([]string, []net.IP) {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		hosts = append([]string{hostname}, hosts...)
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logging.Warning.Println("Failed to list network interfaces:", err)
+		return hosts, ips
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+
+	return hosts, ips
+}
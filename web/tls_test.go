@@ -0,0 +1,173 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertificateCoversHosts(t *testing.T) {
+	hosts := []string{"filete-host", "localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback, net.IPv4(192, 168, 1, 20)}
+
+	certPEM, keyPEM, err := generateSelfSignedCertificate(hosts, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Generated key pair doesn't load: %v", err)
+	}
+	leaf := parseLeaf(t, cert)
+
+	if leaf.Subject.CommonName != "filete-host" {
+		t.Fatalf("Expected common name filete-host. Got %s", leaf.Subject.CommonName)
+	}
+	if !slices.Equal(leaf.DNSNames, hosts) {
+		t.Fatalf("Expected DNS names %v. Got %v", hosts, leaf.DNSNames)
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(leaf.IPAddresses, ip.Equal) {
+			t.Fatalf("Expected IP %s among %v", ip, leaf.IPAddresses)
+		}
+	}
+	for _, name := range []string{"filete-host", "localhost", "127.0.0.1", "::1", "192.168.1.20"} {
+		if err := leaf.VerifyHostname(name); err != nil {
+			t.Fatalf("Expected certificate to be valid for %s: %v", name, err)
+		}
+	}
+	if err := leaf.VerifyHostname("192.168.1.21"); err == nil {
+		t.Fatal("Expected certificate to be invalid for other IPs")
+	}
+	if !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageServerAuth) {
+		t.Fatalf("Expected server auth usage. Got %v", leaf.ExtKeyUsage)
+	}
+	if time.Until(leaf.NotAfter) < selfSignedCertLifetime-time.Hour {
+		t.Fatalf("Expected certificate to be valid for %v. Expires %v", selfSignedCertLifetime, leaf.NotAfter)
+	}
+}
+
+func TestCachedCertificateIsReused(t *testing.T) {
+	configs := ServerConfigs{SelfSigned: true, CertCacheDir: filepath.Join(t.TempDir(), "certs")}
+
+	first, err := loadCertificate(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(configs.CertCacheDir, SelfSignedKeyFileName))
+	if err != nil {
+		t.Fatalf("Expected the key to be cached: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the cached key to be private. Got mode %v", info.Mode().Perm())
+	}
+
+	second, err := loadCertificate(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificateFingerprint(first) != certificateFingerprint(second) {
+		t.Fatal("Expected the cached certificate to be reused")
+	}
+}
+
+func TestCachedCertificateIsRegenerated(t *testing.T) {
+	hosts, ips := localHostsAndIps()
+
+	tests := []struct {
+		name     string
+		hosts    []string
+		ips      []net.IP
+		notAfter time.Time
+	}{
+		{"about to expire", hosts, ips, time.Now().Add(time.Hour)},
+		{"host changed", []string{"previous-host"}, ips, time.Now().Add(selfSignedCertLifetime)},
+		{"IP changed", hosts, []net.IP{net.IPv4(192, 0, 2, 1)}, time.Now().Add(selfSignedCertLifetime)},
+	}
+
+	for _, test := range tests {
+		configs := ServerConfigs{SelfSigned: true, CertCacheDir: t.TempDir()}
+		stale := writeCachedCertificate(t, configs.CertCacheDir, test.hosts, test.ips, test.notAfter)
+
+		if _, err := loadCachedCertificate(configs.CertCacheDir, hosts, ips); err == nil {
+			t.Fatalf("%s: expected the cached certificate to be rejected", test.name)
+		}
+
+		cert, err := loadCertificate(configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certificateFingerprint(cert) == certificateFingerprint(stale) {
+			t.Fatalf("%s: expected a new certificate", test.name)
+		}
+
+		// The new one replaces the stale one in the cache
+		cached, err := loadCachedCertificate(configs.CertCacheDir, hosts, ips)
+		if err != nil {
+			t.Fatalf("%s: expected the new certificate to be cached: %v", test.name, err)
+		}
+		if certificateFingerprint(cached) != certificateFingerprint(cert) {
+			t.Fatalf("%s: expected the cache to hold the new certificate", test.name)
+		}
+	}
+}
+
+// Caches a certificate expiring at notAfter in dir, e.g. one generated on an
+// earlier run
+func writeCachedCertificate(t *testing.T, dir string, hosts []string, ips []net.IP, notAfter time.Time) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notAfter.Add(-selfSignedCertLifetime),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     hosts,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := persistCertificate(dir, certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func parseLeaf(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
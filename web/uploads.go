@@ -0,0 +1,235 @@
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/logging"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web/middleware"
+	"github.com/sunkit02/filete/web/utils"
+)
+
+// Resumable uploads following the tus 1.0 core protocol with the creation,
+// creation-with-upload and termination extensions. See https://tus.io/protocols/resumable-upload
+
+const (
+	TusVersion         = "1.0.0"
+	TusExtensions      = "creation,creation-with-upload,termination"
+	TusChunkMediaType  = "application/offset+octet-stream"
+	TusUploadsLocation = "/api/uploads/"
+)
+
+func registerUploadRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("OPTIONS /uploads", handleTusOptions)
+	mux.Handle("POST /uploads", requires(services.PermissionUpload, tusResumable(http.HandlerFunc(handleCreateUpload))))
+	mux.Handle("HEAD /uploads/{id}", requires(services.PermissionUpload, tusResumable(http.HandlerFunc(handleGetUploadOffset))))
+	mux.Handle("PATCH /uploads/{id}", requires(services.PermissionUpload, tusResumable(http.HandlerFunc(handlePatchUpload))))
+	mux.Handle("DELETE /uploads/{id}", requires(services.PermissionUpload, tusResumable(http.HandlerFunc(handleDeleteUpload))))
+}
+
+// Rejects requests for a tus version we don't support and marks every
+// response with the version we speak.
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+
+		if r.Header.Get("Tus-Resumable") != TusVersion {
+			id := middleware.ExtractRequestId(r)
+			w.Header().Set("Tus-Version", TusVersion)
+			http.Error(w, utils.WithId(id, "Unsupported tus version"), http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, utils.WithId(id, "Invalid Upload-Length"), http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, utils.WithId(id, "Invalid Upload-Metadata"), http.StatusBadRequest)
+		return
+	}
+
+	session, _ := middleware.ExtractSession(r)
+	upload, err := services.CreateUpload(session, length, metadata)
+	if err != nil {
+		logging.Error.Println(utils.WithId(id, "Failed to create upload: %v", err))
+		http.Error(w, utils.WithId(id, "Failed to create upload"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", TusUploadsLocation+upload.Id)
+
+	// creation-with-upload: the body holds the first chunk. The client can
+	// still resume through Location if it fails.
+	if r.Header.Get("Content-Type") == TusChunkMediaType {
+		upload, err = services.WriteUploadChunk(session, upload.Id, 0, r.Body)
+		if err != nil {
+			writeUploadError(w, id, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleGetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+
+	upload, ok := getManageableUpload(w, r, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
+
+	if r.Header.Get("Content-Type") != TusChunkMediaType {
+		http.Error(w, utils.WithId(id, "Content-Type must be "+TusChunkMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, utils.WithId(id, "Invalid Upload-Offset"), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := getManageableUpload(w, r, id); !ok {
+		return
+	}
+
+	upload, err := services.WriteUploadChunk(session, r.PathValue("id"), offset, r.Body)
+	if err != nil {
+		writeUploadError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Completed uploads attached to a message can't be deleted, the message would
+// lose its attachment
+func handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+
+	upload, ok := getManageableUpload(w, r, id)
+	if !ok {
+		return
+	}
+
+	if upload.IsComplete() {
+		attached, err := isUploadAttached(upload.Id)
+		if err != nil {
+			logging.Error.Println(utils.WithId(id, "Failed to read messages: %v", err))
+			http.Error(w, utils.WithId(id, "Failed to delete upload"), http.StatusInternalServerError)
+			return
+		}
+		if attached {
+			http.Error(w, utils.WithId(id, "Upload is attached to a message"), http.StatusConflict)
+			return
+		}
+	}
+
+	err := services.DeleteUpload(upload.Id)
+	if err != nil {
+		writeUploadError(w, id, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the upload of the `id` path value if the session created it or is
+// an admin, writing an error response and returning false if not
+func getManageableUpload(w http.ResponseWriter, r *http.Request, id uuid.UUID) (services.Upload, bool) {
+	session, _ := middleware.ExtractSession(r)
+
+	upload, err := services.GetUpload(r.PathValue("id"))
+	if err != nil {
+		writeUploadError(w, id, err)
+		return services.Upload{}, false
+	}
+	if !upload.IsManageableBy(session) {
+		http.Error(w, utils.WithId(id, "Upload was created by another session"), http.StatusForbidden)
+		return services.Upload{}, false
+	}
+
+	return upload, true
+}
+
+func writeUploadError(w http.ResponseWriter, id uuid.UUID, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, services.ErrUploadNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, services.ErrOffsetMismatch), errors.Is(err, services.ErrUploadCompleted):
+		status = http.StatusConflict
+	case errors.Is(err, services.ErrUploadLocked):
+		status = http.StatusLocked
+	case errors.Is(err, services.ErrUploadTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	if status == http.StatusInternalServerError {
+		logging.Error.Println(utils.WithId(id, err.Error()))
+		http.Error(w, utils.WithId(id, "Internal error"), status)
+	} else {
+		logging.Debug.Println(utils.WithId(id, err.Error()))
+		http.Error(w, utils.WithId(id, err.Error()), status)
+	}
+}
+
+// Parses the Upload-Metadata header, a comma separated list of keys with
+// optional base64 encoded values.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Empty metadata key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
@@ -2,22 +2,33 @@ package web
 
 import (
 	"crypto/tls"
-	"fmt"
 	"io/fs"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/sunkit02/filete/data"
 	"github.com/sunkit02/filete/logging"
 	"github.com/sunkit02/filete/services"
-	"github.com/sunkit02/filete/utils"
 	mw "github.com/sunkit02/filete/web/middleware"
 )
 
 type ServerConfigs struct {
-	Port     uint16
+	Port uint16
+	// Address to listen on. Listens on all interfaces if empty.
+	Bind     string
 	CertFile string
 	KeyFile  string
 
+	// Generate a self-signed certificate at startup instead of reading
+	// CertFile and KeyFile
+	SelfSigned bool
+	// Directory to persist the generated self-signed certificate in so it is
+	// reused across restarts. Not persisted if empty.
+	CertCacheDir string
+
 	// Path to directory holding static assets
 	Assets fs.FS
 
@@ -25,37 +36,87 @@ type ServerConfigs struct {
 	// NOTE: Must be pointing to a directory or empty
 	UploadDir string
 
-	// Path to directories to be shared
-	ShareDirs []string
-
-	// Key required to be entered by client to authenticate. The server will
-	// generate a random one if left empty.
+	// Directories to be shared
+	ShareDirs []services.SharedDirectoryConfig
+	// .gitignore style patterns excluded from every shared directory
+	Excludes []string
+	// Backend storing messages inside UploadDir
+	MessageStore data.MessageStore
+	// When the message store is synced to disk, see data.FsyncPolicy
+	MessageFsync data.FsyncPolicy
+	// Where sessions are kept. File sessions are persisted inside UploadDir.
+	SessionStore services.SessionStoreType
+	// Replace the session key after this many wrong keys. Disabled if 0.
+	RotateKeyAfter int
+	// Entropy of generated session keys and session ids, see
+	// services.AuthServiceConfig
+	SessionKeyGroups int
+	SessionIdBytes   int
+
+	// Key required to be entered by client to authenticate as admin. The
+	// server will generate a random one if left empty.
 	SessionKey string
+	// Additional keys granting other roles
+	SessionKeys []services.SessionKeyConfig
+	// Identities set up by the admin, see services.IdentityServiceConfig
+	Identities []data.Identity
 }
 
 var (
-	sessionKey  string
-	messageRepo data.Repository[data.MessageId, data.Message]
+	uploadDir   string
+	messageRepo data.MessageRepository
 )
 
 func StartServer(configs ServerConfigs) {
-	r := data.NewFileMessageRepo(configs.UploadDir + "/messages.dat")
-	messageRepo = &r
+	if err := os.MkdirAll(configs.UploadDir, 0755); err != nil {
+		logging.Error.Fatalf("Failed to create upload directory: %v\n", err)
+	}
+	uploadDir = configs.UploadDir
 
-	// Ensure that the session key is not empty
-	if configs.SessionKey == "" {
-		configs.SessionKey = utils.GenerateRandomString(8)
+	repo, err := data.OpenMessageRepo(configs.MessageStore, configs.UploadDir, data.FileMessageRepoOptions{
+		Fsync: configs.MessageFsync,
+	})
+	if err != nil {
+		logging.Error.Fatalf("Failed to open message store: %v\n", err)
 	}
-	sessionKey = configs.SessionKey
+	messageRepo = repo
 
 	// Init services
-	services.InitDownloadService(services.DownloadServiceConfig{
+	err = services.InitDownloadService(services.DownloadServiceConfig{
 		SharedDirectories: configs.ShareDirs,
+		Excludes:          configs.Excludes,
+	})
+	if err != nil {
+		logging.Error.Fatalf("Failed to initialize download service: %v\n", err)
+	}
+
+	err = services.InitUploadService(services.UploadServiceConfig{
+		UploadDir: configs.UploadDir,
 	})
+	if err != nil {
+		logging.Error.Fatalf("Failed to initialize upload service: %v\n", err)
+	}
 
-	services.InitAuthService(services.AuthServiceConfig{
-		SessionKey: configs.SessionKey,
+	err = services.InitIdentityService(services.IdentityServiceConfig{
+		Path:       filepath.Join(configs.UploadDir, data.IdentityFileName),
+		Identities: configs.Identities,
 	})
+	if err != nil {
+		logging.Error.Fatalf("Failed to initialize identity service: %v\n", err)
+	}
+
+	err = services.InitAuthService(services.AuthServiceConfig{
+		SessionKey:       configs.SessionKey,
+		Keys:             configs.SessionKeys,
+		SessionKeyGroups: configs.SessionKeyGroups,
+		SessionIdBytes:   configs.SessionIdBytes,
+		SessionStore:     configs.SessionStore,
+		SessionFile:      filepath.Join(configs.UploadDir, services.SessionFileName),
+		Limits:           services.LoginLimits{RotateKeyAfter: configs.RotateKeyAfter},
+	})
+	if err != nil {
+		logging.Error.Fatalf("Failed to initialize auth service: %v\n", err)
+	}
 
 	// Initialize routes
 	composedMux := http.NewServeMux()
@@ -70,19 +131,26 @@ func StartServer(configs ServerConfigs) {
 		mw.RequestIdMiddleware(
 			mw.RequestLoggingMiddleware(composedMux)))
 
+	cert, err := loadCertificate(configs)
+	if err != nil {
+		logging.Error.Fatalf("Failed to load TLS certificate: %v\n", err)
+	}
+
 	// Define the HTTPS server configuration
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", configs.Port),
+		Addr:    net.JoinHostPort(configs.Bind, strconv.Itoa(int(configs.Port))),
 		Handler: topLevelMux,
 		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS13,
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{cert},
 		},
 	}
 
 	// Start the HTTPS server
-	logging.Info.Printf("Start listening on port %d with TLS\n", configs.Port)
-	logging.Info.Println("Session key:", sessionKey)
-	if err := server.ListenAndServeTLS(configs.CertFile, configs.KeyFile); err != nil {
+	logging.Info.Printf("Start listening on %s with TLS\n", server.Addr)
+	logging.Info.Println("Session key:", services.SessionKey())
+	logging.Info.Println("Certificate SHA-256 fingerprint:", certificateFingerprint(cert))
+	if err := server.ListenAndServeTLS("", ""); err != nil {
 		logging.Error.Fatalf("Error starting server: %v\n", err)
 	}
 }
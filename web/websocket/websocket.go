@@ -0,0 +1,409 @@
+// Package websocket implements the server side of the WebSocket protocol on
+// top of net/http. See https://datatracker.ietf.org/doc/html/rfc6455
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types, i.e. the opcodes of data frames
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+const (
+	continuationFrame = 0
+	closeFrame        = 8
+	pingFrame         = 9
+	pongFrame         = 10
+)
+
+// Close codes, see https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// Default maximum size of a received message, see Conn.SetReadLimit
+const DefaultReadLimit = 1 << 20 // 1 MB
+
+// Magic value appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrBadHandshake    = errors.New("Invalid WebSocket handshake")
+	ErrOriginMismatch  = errors.New("WebSocket origin doesn't match host")
+	ErrMessageTooBig   = errors.New("WebSocket message too big")
+	ErrProtocolError   = errors.New("WebSocket protocol error")
+	ErrInvalidUTF8     = errors.New("WebSocket text message is not valid UTF-8")
+	ErrConnectionClose = errors.New("WebSocket connection closed")
+)
+
+// Returned by Conn.ReadMessage once the peer closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+type Conn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	readLimit   int64
+	idleTimeout time.Duration
+
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+	closeSent bool
+}
+
+// Completes the opening handshake of a WebSocket connection and takes over the
+// underlying connection. On failure an error response has already been
+// written. Requests with an Origin header whose host differs from the Host of
+// the request are rejected, so cookies can't be used by other sites.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return nil, ErrOriginMismatch
+		}
+	}
+
+	netConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := brw.Writer.WriteString(response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := brw.Writer.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	// Clear deadlines set by the http server for the request
+	netConn.SetDeadline(time.Time{})
+
+	return &Conn{
+		conn:      netConn,
+		reader:    brw.Reader,
+		readLimit: DefaultReadLimit,
+		writer:    brw.Writer,
+	}, nil
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sets the maximum size of a received message. Larger messages close the
+// connection with CloseMessageTooBig.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// Makes reads fail if nothing, not even a pong, is received from the peer for
+// the given duration. Zero disables the timeout.
+func (c *Conn) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// Reads the next data message, reassembling fragmented messages. Pings are
+// answered while reading. Returns a *CloseError after the peer closed the
+// connection.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.failRead(err)
+		}
+
+		switch opcode {
+		case pingFrame:
+			if err := c.writeFrame(pongFrame, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case pongFrame:
+			continue
+		case closeFrame:
+			return 0, nil, c.handleClose(payload)
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.failRead(ErrProtocolError)
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.failRead(ErrProtocolError)
+			}
+			messageType = opcode
+		default:
+			return 0, nil, c.failRead(ErrProtocolError)
+		}
+
+		if int64(len(message))+int64(len(payload)) > c.readLimit {
+			return 0, nil, c.failRead(ErrMessageTooBig)
+		}
+		message = append(message, payload...)
+
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.failRead(ErrInvalidUTF8)
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// Reads the next text message and decodes it as JSON into v
+func (c *Conn) ReadJSON(v any) error {
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(message, v)
+}
+
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	if c.idleTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	// No extensions are negotiated, so the reserved bits must be unset
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, ErrProtocolError
+	}
+	// Clients must mask every frame
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, ErrProtocolError
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	isControl := opcode >= closeFrame
+	if isControl && (!fin || length > 125) {
+		return false, 0, nil, ErrProtocolError
+	}
+	if length > uint64(c.readLimit) {
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Closes the connection after a read error, telling the peer why if the error
+// is on their side
+func (c *Conn) failRead(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocolError):
+		code = CloseProtocolError
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8):
+		code = CloseInvalidPayload
+	}
+
+	if code != 0 {
+		c.Close(code, err.Error())
+	} else {
+		c.conn.Close()
+	}
+	return err
+}
+
+// Answers a close frame of the peer and closes the connection
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	} else if len(payload) == 1 {
+		c.failRead(ErrProtocolError)
+		return ErrProtocolError
+	}
+
+	code := closeErr.Code
+	if code == CloseNoStatus {
+		code = CloseNormal
+	}
+	c.Close(code, "")
+	return closeErr
+}
+
+// Sends a single unfragmented message
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("Invalid message type %d", messageType)
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// Sends v encoded as JSON in a text message
+func (c *Conn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(TextMessage, data)
+}
+
+// Sends a ping, answered by a pong from a responsive peer
+func (c *Conn) Ping() error {
+	return c.writeFrame(pingFrame, nil)
+}
+
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return ErrConnectionClose
+	}
+	if opcode == closeFrame {
+		c.closeSent = true
+	}
+
+	// Servers never mask their frames
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|byte(opcode))
+	switch length := len(payload); {
+	case length <= 125:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if _, err := c.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(payload); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// Sends a close frame with the given code and reason, if none was sent yet,
+// and closes the connection
+func (c *Conn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	// Control frames are limited to 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload = append(payload, reason...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	err := c.writeFrame(closeFrame, payload)
+	if closeErr := c.conn.Close(); err == nil || errors.Is(err, ErrConnectionClose) {
+		err = closeErr
+	}
+	return err
+}
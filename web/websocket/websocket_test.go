@@ -0,0 +1,173 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected accept key %s", got)
+	}
+}
+
+// Starts a server echoing every message and returns a connected client
+func dialEchoServer(t *testing.T, header string) (net.Conn, *bufio.Reader, *http.Response) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request := "GET / HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		header + "\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, reader, response
+}
+
+func writeClientFrame(t *testing.T, w io.Writer, header0 byte, masked bool, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{header0}
+	lengthByte := byte(0)
+	if masked {
+		lengthByte = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, lengthByte|byte(len(payload)))
+	default:
+		frame = append(frame, lengthByte|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	if masked {
+		frame = append(frame, mask[:]...)
+	}
+	for i, b := range payload {
+		if masked {
+			b ^= mask[i%4]
+		}
+		frame = append(frame, b)
+	}
+
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("Server frames must not be masked")
+	}
+
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], payload
+}
+
+func TestEcho(t *testing.T) {
+	conn, reader, response := dialEchoServer(t, "")
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101. Got %d", response.StatusCode)
+	}
+	if got := response.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected Sec-WebSocket-Accept %s", got)
+	}
+
+	long := strings.Repeat("a", 300)
+	writeClientFrame(t, conn, 0x80|TextMessage, true, []byte(long))
+	if header, payload := readServerFrame(t, reader); header != 0x80|TextMessage || string(payload) != long {
+		t.Fatalf("Unexpected echo %x %q", header, payload)
+	}
+
+	// Fragmented message with a ping in between
+	writeClientFrame(t, conn, BinaryMessage, true, []byte("hel"))
+	writeClientFrame(t, conn, 0x80|pingFrame, true, []byte("ping"))
+	writeClientFrame(t, conn, 0x80|continuationFrame, true, []byte("lo"))
+
+	if header, payload := readServerFrame(t, reader); header != 0x80|pongFrame || string(payload) != "ping" {
+		t.Fatalf("Expected pong. Got %x %q", header, payload)
+	}
+	if header, payload := readServerFrame(t, reader); header != 0x80|BinaryMessage || string(payload) != "hello" {
+		t.Fatalf("Unexpected echo %x %q", header, payload)
+	}
+
+	writeClientFrame(t, conn, 0x80|closeFrame, true, binary.BigEndian.AppendUint16(nil, CloseNormal))
+	header, payload := readServerFrame(t, reader)
+	if header != 0x80|closeFrame || binary.BigEndian.Uint16(payload) != CloseNormal {
+		t.Fatalf("Expected close frame. Got %x %v", header, payload)
+	}
+}
+
+func TestUnmaskedFrameIsRejected(t *testing.T) {
+	conn, reader, _ := dialEchoServer(t, "")
+
+	writeClientFrame(t, conn, 0x80|TextMessage, false, []byte("hello"))
+	header, payload := readServerFrame(t, reader)
+	if header != 0x80|closeFrame || binary.BigEndian.Uint16(payload) != CloseProtocolError {
+		t.Fatalf("Expected close with protocol error. Got %x %v", header, payload)
+	}
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected connection to be closed. Got %v", err)
+	}
+}
+
+func TestOriginMismatchIsRejected(t *testing.T) {
+	_, _, response := dialEchoServer(t, "Origin: https://evil.example\r\n")
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status 403. Got %d", response.StatusCode)
+	}
+}
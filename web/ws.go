@@ -0,0 +1,181 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sunkit02/filete/data"
+	"github.com/sunkit02/filete/logging"
+	"github.com/sunkit02/filete/services"
+	"github.com/sunkit02/filete/web/middleware"
+	"github.com/sunkit02/filete/web/utils"
+	"github.com/sunkit02/filete/web/websocket"
+)
+
+// WebSocket transport carrying the same events as /api/events plus messages
+// sent by the client. Every frame is a JSON text message of the form
+//
+//	{"type": "...", "id": "...", "ref": "...", "data": ...}
+//
+// Events published by the server use the event type and id. Frames sent by
+// the client carry a `ref` of their choosing which is copied into the reply.
+
+// Types of frames sent by clients and of the replies to them
+const (
+	WsSendMessage = "send-message"
+	WsMessageSent = "message-sent"
+	WsError       = "error"
+)
+
+const (
+	// Interval of the pings keeping the connection alive
+	WsPingInterval = 30 * time.Second
+	// Connections not answering pings are closed after this long
+	WsIdleTimeout = 2 * WsPingInterval
+	// Maximum size of a frame sent by a client
+	WsMaxMessageSize = 64 << 10 // 64 KB
+)
+
+type wsFrame struct {
+	Type string          `json:"type"`
+	Id   string          `json:"id,omitempty"`
+	Ref  string          `json:"ref,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type wsReply struct {
+	Type string `json:"type"`
+	Id   string `json:"id,omitempty"`
+	Ref  string `json:"ref,omitempty"`
+	Data any    `json:"data,omitempty"`
+}
+
+type wsErrorData struct {
+	Message string `json:"message"`
+}
+
+func registerWebSocketRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /ws", requires(services.PermissionReadMessages, http.HandlerFunc(handleWebSocket)))
+}
+
+// Like /api/events, query parameter `last-event-id` replays the messages
+// created after the given id once connected.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	id := middleware.ExtractRequestId(r)
+	session, _ := middleware.ExtractSession(r)
+
+	replayAfter, replay, err := parseLastEventId(r)
+	if err != nil {
+		http.Error(w, utils.WithId(id, "Invalid last-event-id"), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logging.Debug.Println(utils.WithId(id, "WebSocket upgrade failed: %v", err))
+		return
+	}
+	conn.SetReadLimit(WsMaxMessageSize)
+	conn.SetIdleTimeout(WsIdleTimeout)
+	logging.Info.Println(utils.WithId(id, "WebSocket connected"))
+
+	events, unsubscribe := services.SubscribeEvents(session)
+	defer unsubscribe()
+
+	if replay {
+		replayAfter, err = replayMessages(replayAfter, func(event services.Event) error {
+			return conn.WriteJSON(wsReply{Type: event.Type, Id: event.Id, Data: event.Data})
+		})
+		if err != nil {
+			logging.Error.Println(utils.WithId(id, "Failed to replay messages: %v", err))
+			conn.Close(websocket.CloseInternalError, "Failed to replay messages")
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readWebSocketFrames(conn, session, id)
+	}()
+
+	ping := time.NewTicker(WsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			logging.Info.Println(utils.WithId(id, "WebSocket disconnected"))
+			return
+		case <-ping.C:
+			err = conn.Ping()
+		case event, ok := <-events:
+			if !ok {
+				conn.Close(websocket.CloseGoingAway, "Fell behind on events, reconnect with last-event-id")
+				<-done
+				return
+			}
+			if isReplayed(event, replayAfter) {
+				continue
+			}
+			err = conn.WriteJSON(wsReply{Type: event.Type, Id: event.Id, Data: event.Data})
+		}
+
+		if err != nil {
+			logging.Debug.Println(utils.WithId(id, "Failed to write to WebSocket: %v", err))
+			conn.Close(websocket.CloseGoingAway, "")
+			<-done
+			return
+		}
+	}
+}
+
+// Handles frames sent by the client until the connection is closed
+func readWebSocketFrames(conn *websocket.Conn, session services.UserSession, id uuid.UUID) {
+	for {
+		var frame wsFrame
+		err := conn.ReadJSON(&frame)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			conn.WriteJSON(wsReply{Type: WsError, Data: wsErrorData{Message: "Invalid frame"}})
+			continue
+		} else if err != nil {
+			logging.Debug.Println(utils.WithId(id, "WebSocket read ended: %v", err))
+			return
+		}
+
+		reply := handleWebSocketFrame(frame, session, id)
+		reply.Ref = frame.Ref
+		if err := conn.WriteJSON(reply); err != nil {
+			return
+		}
+	}
+}
+
+func handleWebSocketFrame(frame wsFrame, session services.UserSession, id uuid.UUID) wsReply {
+	switch frame.Type {
+	case WsSendMessage:
+		if !session.Role.Can(services.PermissionPostMessages) {
+			return wsReply{Type: WsError, Data: wsErrorData{Message: "Not allowed to send messages"}}
+		}
+		var message data.Message
+		if err := json.Unmarshal(frame.Data, &message); err != nil {
+			return wsReply{Type: WsError, Data: wsErrorData{Message: "Invalid message"}}
+		}
+
+		message, err := createMessage(message, session)
+		if isAttachmentError(err) {
+			return wsReply{Type: WsError, Data: wsErrorData{Message: "Invalid attachment: " + err.Error()}}
+		} else if err != nil {
+			logging.Error.Println(utils.WithId(id, "Failed to write new message to file: %v", err))
+			return wsReply{Type: WsError, Data: wsErrorData{Message: "Failed to send new message"}}
+		}
+		return wsReply{Type: WsMessageSent, Data: message}
+	default:
+		return wsReply{Type: WsError, Data: wsErrorData{Message: "Unknown frame type " + frame.Type}}
+	}
+}